@@ -0,0 +1,249 @@
+package ghp
+
+import (
+  "errors"
+  "net/http"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+// DefaultEventStreamKeepAlive is the default interval of keep-alive comments
+//
+const DefaultEventStreamKeepAlive = 15 * time.Second
+
+var ErrEventStreamClosed = errors.New("event stream closed")
+
+// Event is a Server-Sent Event. Only non-empty fields are sent.
+//
+type Event struct {
+  ID    string         // sets the client's last event ID
+  Event string         // event type. Defaults to "message" on the client
+  Data  string         // payload. May contain multiple lines
+  Retry time.Duration  // client reconnection time
+}
+
+// EventStream sends Server-Sent Events (text/event-stream) to a client.
+//
+// Keep-alive comments are sent while the stream is idle, to keep proxies
+// and clients from closing the connection.
+//
+// Done is closed when the client disconnects, when the servlet instance is
+// being replaced or stopped, or when Close is called. The servlet should
+// return from ServeHTTP when this happens, and must call Close before
+// returning.
+//
+// Methods are safe to call from any goroutine.
+//
+type EventStream struct {
+  r         *Request
+  w         Response
+  mu        sync.Mutex  // serializes writes
+  closed    bool
+  lastWrite time.Time
+  done      chan struct{}
+  closeOnce sync.Once
+  keepAlive chan time.Duration
+  stopped   chan struct{}  // closed when run has returned
+}
+
+// NewEventStream starts an event stream responding to r.
+// A "200 OK" header is sent immediately.
+//
+func NewEventStream(r *Request, w Response) *EventStream {
+  h := w.Header()
+  h.Set("Content-Type", "text/event-stream; charset=utf-8")
+  h.Set("Cache-Control", "no-cache")
+  h.Set("X-Accel-Buffering", "no")  // disable buffering in nginx
+  h.Del("Content-Length")
+
+  // streams are long-lived and should not be cut off by server timeouts
+  if c, ok := w.(interface{ ClearDeadlines() }); ok {
+    c.ClearDeadlines()
+  }
+
+  w.WriteHeader(http.StatusOK)
+  w.Flush()
+
+  es := &EventStream{
+    r: r,
+    w: w,
+    lastWrite: time.Now(),
+    done: make(chan struct{}),
+    keepAlive: make(chan time.Duration, 1),
+    stopped: make(chan struct{}),
+  }
+  go es.run(DefaultEventStreamKeepAlive)
+  return es
+}
+
+// LastEventID returns the ID of the last event received by the client
+// before it reconnected, from the "Last-Event-ID" header or the
+// "lastEventId" query parameter. Returns "" for new clients.
+//
+func (es *EventStream) LastEventID() string {
+  if id := es.r.Header.Get("Last-Event-ID"); id != "" {
+    return id
+  }
+  return es.r.URL.Query().Get("lastEventId")
+}
+
+// Done returns a channel which is closed when the stream ends
+//
+func (es *EventStream) Done() <-chan struct{} {
+  return es.done
+}
+
+// SetKeepAlive changes the interval of keep-alive comments.
+// 0 disables keep-alive comments.
+//
+func (es *EventStream) SetKeepAlive(interval time.Duration) {
+  select {
+  case <-es.keepAlive:  // replace any pending value
+  default:
+  }
+  select {
+  case es.keepAlive <- interval:
+  case <-es.done:
+  }
+}
+
+// Send sends event e to the client
+//
+func (es *EventStream) Send(e *Event) error {
+  var b strings.Builder
+  if e.ID != "" {
+    b.WriteString("id: ")
+    b.WriteString(eventFieldValue(e.ID))
+    b.WriteByte('\n')
+  }
+  if e.Event != "" {
+    b.WriteString("event: ")
+    b.WriteString(eventFieldValue(e.Event))
+    b.WriteByte('\n')
+  }
+  if e.Retry > 0 {
+    b.WriteString("retry: ")
+    b.WriteString(strconv.FormatInt(int64(e.Retry / time.Millisecond), 10))
+    b.WriteByte('\n')
+  }
+  if e.Data != "" || (e.ID == "" && e.Event == "" && e.Retry == 0) {
+    data := strings.Replace(e.Data, "\r\n", "\n", -1)
+    data = strings.Replace(data, "\r", "\n", -1)
+    for _, line := range strings.Split(data, "\n") {
+      b.WriteString("data: ")
+      b.WriteString(line)
+      b.WriteByte('\n')
+    }
+  }
+  b.WriteByte('\n')
+  return es.write(b.String())
+}
+
+// SendData sends a "message" event with data
+//
+func (es *EventStream) SendData(data string) error {
+  return es.Send(&Event{ Data: data })
+}
+
+// Comment sends a comment, which is ignored by clients
+//
+func (es *EventStream) Comment(text string) error {
+  return es.write(": " + eventFieldValue(text) + "\n\n")
+}
+
+// Close ends the stream. Nothing is written to the response once Close has
+// returned. Calling it more than once has no effect.
+//
+func (es *EventStream) Close() error {
+  es.close()
+  <-es.stopped
+  return nil
+}
+
+// close ends the stream without waiting for run to return
+//
+func (es *EventStream) close() {
+  es.mu.Lock()
+  es.closed = true
+  es.mu.Unlock()
+  es.closeOnce.Do(func() { close(es.done) })
+}
+
+func (es *EventStream) write(s string) error {
+  es.mu.Lock()
+  defer es.mu.Unlock()
+  return es.writeLocked(s)
+}
+
+// writeLocked writes s. es.mu must be held.
+//
+func (es *EventStream) writeLocked(s string) error {
+  if es.closed {
+    return ErrEventStreamClosed
+  }
+  if _, err := es.w.WriteString(s); err != nil {
+    return err
+  }
+  es.w.Flush()
+  es.lastWrite = time.Now()
+  return nil
+}
+
+// run sends keep-alive comments and closes the stream when the client
+// disconnects or the servlet is stopping.
+//
+func (es *EventStream) run(interval time.Duration) {
+  defer close(es.stopped)
+  var tick <-chan time.Time
+  var ticker *time.Ticker
+  setInterval := func(d time.Duration) {
+    if ticker != nil {
+      ticker.Stop()
+      ticker, tick = nil, nil
+    }
+    interval = d
+    if d > 0 {
+      ticker = time.NewTicker(d)
+      tick = ticker.C
+    }
+  }
+  setInterval(interval)
+  defer setInterval(0)
+
+  ctx := (*http.Request)(es.r).Context()
+  for {
+    select {
+    case <-es.done:
+      return
+    case <-ctx.Done():
+      es.close()
+      return
+    case <-es.r.Stopping():
+      es.close()
+      return
+    case d := <-es.keepAlive:
+      setInterval(d)
+    case <-tick:
+      // checked and written under the lock Close takes, so that nothing is
+      // written once the stream is closed
+      es.mu.Lock()
+      if time.Since(es.lastWrite) >= interval {
+        es.writeLocked(": \n\n")
+      }
+      es.mu.Unlock()
+    }
+  }
+}
+
+// eventFieldValue strips line breaks from s, which are not allowed in
+// field values other than data.
+//
+func eventFieldValue(s string) string {
+  if strings.ContainsAny(s, "\r\n") {
+    s = strings.Replace(s, "\r", "", -1)
+    s = strings.Replace(s, "\n", "", -1)
+  }
+  return s
+}
@@ -0,0 +1,33 @@
+// An example of streaming Server-Sent Events
+package main
+
+import (
+  "strconv"
+  "time"
+
+  "github.com/rsms/ghp"
+)
+
+func ServeHTTP(r *ghp.Request, w ghp.Response) {
+  es := ghp.NewEventStream(r, w)
+  defer es.Close()
+
+  // resume from the last event the client received, if any
+  n, _ := strconv.Atoi(es.LastEventID())
+
+  ticker := time.NewTicker(1 * time.Second)
+  defer ticker.Stop()
+  for {
+    select {
+    case <-es.Done():
+      return
+    case t := <-ticker.C:
+      n++
+      es.Send(&ghp.Event{
+        ID: strconv.Itoa(n),
+        Event: "time",
+        Data: t.Format(time.RFC3339),
+      })
+    }
+  }
+}
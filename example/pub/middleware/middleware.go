@@ -0,0 +1,18 @@
+// An example of middleware, applied to everything in this directory
+package main
+
+import (
+  "log"
+  "time"
+
+  "github.com/rsms/ghp"
+)
+
+func Middleware(next ghp.ServeHTTP) ghp.ServeHTTP {
+  return func(r *ghp.Request, w ghp.Response) {
+    start := time.Now()
+    w.Header().Set("X-Middleware", "example")
+    next(r, w)
+    log.Printf("[middleware example] %s took %s", r.URL.Path, time.Since(start))
+  }
+}
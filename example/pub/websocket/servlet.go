@@ -0,0 +1,23 @@
+// An example of a WebSocket echo server
+package main
+
+import (
+  "github.com/rsms/ghp"
+)
+
+func ServeHTTP(r *ghp.Request, w ghp.Response) {
+  ws, err := ghp.UpgradeWebSocket(r, w)
+  if err != nil {
+    return
+  }
+  defer ws.Close()
+  for {
+    typ, msg, err := ws.ReadMessage()
+    if err != nil {
+      return
+    }
+    if err := ws.WriteMessage(typ, msg); err != nil {
+      return
+    }
+  }
+}
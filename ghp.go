@@ -1,7 +1,9 @@
 package ghp
 
 import (
-  // "net/url"
+  "bufio"
+  "net"
+  "net/url"
   "net/http"
 )
 
@@ -27,17 +29,132 @@ type StopServlet = func(ServletContext)
 //
 type ServeHTTP = func(*Request, Response)
 
+// Middleware is called by GHP with the handler of a request in the
+// middleware's directory or its subdirectories, and returns the handler
+// to call instead. This usually calls next, possibly with a modified
+// request or a wrapped response, but may also respond on its own.
+//
+type Middleware = func(next ServeHTTP) ServeHTTP
+
 // ServletContext represents the servlet instance itself.
 //
 type ServletContext interface {
   Name() string      // servlet name
   Version() string   // instance version
+  Metrics() Metrics  // for registering the servlet's own metrics
 }
 
 // Request represents a HTTP request.
 //
 type Request http.Request
 
+// Param returns the value of a named capture of the route that matched
+// the request, or "" if there's no such capture.
+//
+func (r *Request) Param(name string) string {
+  if st := r.state(); st != nil {
+    return st.Params[name]
+  }
+  return ""
+}
+
+// Params returns all named captures of the route that matched the request.
+// Returns nil if the request did not match a route.
+//
+func (r *Request) Params() map[string]string {
+  if st := r.state(); st != nil {
+    return st.Params
+  }
+  return nil
+}
+
+// OriginalURL returns the URL as it was requested by the client, with its
+// path cleaned, before any rewrites were applied. r.URL is the rewritten URL.
+//
+func (r *Request) OriginalURL() *url.URL {
+  if st := r.state(); st != nil && st.OriginalURL != nil {
+    return st.OriginalURL
+  }
+  return r.URL
+}
+
+// PathInfo returns the part of the URL path below the servlet's directory
+// when a servlet serves a path in its subtree, e.g. "/users/42" for a
+// request for "/api/users/42" served by the servlet in "/api".
+// Returns "" when the request is for the servlet's directory itself.
+//
+func (r *Request) PathInfo() string {
+  if st := r.state(); st != nil {
+    return st.PathInfo
+  }
+  return ""
+}
+
+// Stopping returns a channel which is closed when the servlet instance
+// serving the request is being replaced or stopped. Long-running responses
+// should end when this happens. Returns nil (never closed) when the request
+// is not served by a servlet.
+//
+func (r *Request) Stopping() <-chan struct{} {
+  if st := r.state(); st != nil {
+    return st.Stopping
+  }
+  return nil
+}
+
+// User returns the name of the user authenticated with HTTP Basic auth
+// for a password-protected path, or "" if the path is not protected.
+//
+func (r *Request) User() string {
+  if st := r.state(); st != nil {
+    return st.User
+  }
+  return ""
+}
+
+// ClientIP returns the IP address of the client. This is the address of
+// the peer, or of the client behind a trusted proxy (trusted-proxies and
+// proxy-protocol in the server config).
+//
+func (r *Request) ClientIP() string {
+  if st := r.state(); st != nil && st.ClientIP != "" {
+    return st.ClientIP
+  }
+  if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+    return host
+  }
+  return r.RemoteAddr
+}
+
+func (r *Request) state() *RequestState {
+  st, _ := (*http.Request)(r).Context().Value(RequestStateKey).(*RequestState)
+  return st
+}
+
+// RequestState holds information attached to a request by GHP.
+// It is stored in the request's context under RequestStateKey.
+// Servlets should use the accessor methods of Request rather than
+// accessing this directly.
+//
+type RequestState struct {
+  OriginalURL *url.URL           // URL before any rewrites
+  Params      map[string]string  // named captures of matching route
+  PathInfo    string             // path below servlet directory
+  Stopping    <-chan struct{}    // closed when the servlet is stopping
+  User        string             // authenticated user of protected path
+  ClientIP    string             // IP address of client. See Request.ClientIP
+}
+
+// RequestStateKey is the context key for a request's *RequestState
+//
+var RequestStateKey = &contextKey{"request-state"}
+
+type contextKey struct {
+  name string
+}
+
+func (k *contextKey) String() string { return "ghp context value " + k.name }
+
 // Response represents a HTTP response.
 // Implements io.Writable
 // Implements http.ResponseWriter
@@ -50,4 +167,15 @@ type Response interface {
   Print(a interface{}) (int, error)
   Printf(format string, arg... interface{}) (int, error)
   Flush() bool  // returns true on success
+
+  // WriteError responds with the error page for statusCode, which is the
+  // nearest "<statusCode>.ghp" page or a built-in page.
+  // err is optional and only shown in development mode.
+  WriteError(statusCode int, err error)
+
+  // Hijack lets the servlet take over the connection, e.g. for a protocol
+  // upgrade. See http.Hijacker. The connection is exempt from timeouts and
+  // is closed when the server shuts down or the servlet is stopped.
+  // UpgradeWebSocket is usually more convenient.
+  Hijack() (net.Conn, *bufio.ReadWriter, error)
 }
@@ -0,0 +1,170 @@
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "io"
+  "net/http"
+  "os"
+  "strconv"
+  "sync"
+  "time"
+)
+
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+
+// AccessLog writes a line for each completed request
+//
+type AccessLog struct {
+  format string  // "common", "combined" or "json"
+  w      io.Writer
+  f      *os.File  // non-nil when writing to a file
+  mu     sync.Mutex
+}
+
+
+func OpenAccessLog(c *AccessLogConfig) (*AccessLog, error) {
+  l := &AccessLog{
+    format: c.Format,
+    w: os.Stdout,
+  }
+  if c.File != "" && c.File != "-" {
+    f, err := os.OpenFile(c.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+    if err != nil {
+      return nil, err
+    }
+    l.f = f
+    l.w = f
+  }
+  return l, nil
+}
+
+
+func (l *AccessLog) Close() error {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  if l.f != nil {
+    err := l.f.Close()
+    l.f = nil
+    l.w = nil
+    return err
+  }
+  return nil
+}
+
+
+type accessLogEntry struct {
+  Time      string  `json:"time"`
+  Remote    string  `json:"remote"`
+  User      string  `json:"user,omitempty"`
+  Host      string  `json:"host"`
+  Method    string  `json:"method"`
+  URI       string  `json:"uri"`
+  Proto     string  `json:"proto"`
+  Status    int     `json:"status"`
+  Bytes     int64   `json:"bytes"`
+  Duration  float64 `json:"duration"`  // seconds
+  Referer   string  `json:"referer,omitempty"`
+  UserAgent string  `json:"user_agent,omitempty"`
+  Handler   string  `json:"handler,omitempty"`
+}
+
+
+// Log writes an entry for request r, responded to with w, which started
+// at time start.
+//
+func (l *AccessLog) Log(r *http.Request, w *HttpResponse, start time.Time) {
+  e := accessLogEntry{
+    Remote: clientIP(r),
+    Host: r.Host,
+    Method: r.Method,
+    URI: r.RequestURI,
+    Proto: r.Proto,
+    Status: w.Status(),
+    Bytes: w.written,
+    Duration: time.Since(start).Seconds(),
+    Referer: r.Referer(),
+    UserAgent: r.UserAgent(),
+    Handler: w.handlerType,
+  }
+  if w.handlerName != "" {
+    e.Handler += ":" + w.handlerName
+  }
+  if w.r != nil {
+    if st := requestState(w.r); st != nil {
+      e.User = st.User
+      if st.ClientIP != "" {
+        e.Remote = st.ClientIP
+      }
+    }
+  }
+
+  var b bytes.Buffer
+  if l.format == "json" {
+    e.Time = start.UTC().Format(time.RFC3339Nano)
+    if err := json.NewEncoder(&b).Encode(&e); err != nil {
+      logf("[access-log] %v", err)
+      return
+    }
+  } else {
+    e.Time = start.Format(clfTimeFormat)
+    l.formatCLF(&b, &e)
+  }
+
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  if l.w != nil {
+    l.w.Write(b.Bytes())
+  }
+}
+
+
+// formatCLF writes e in Common Log Format, or Combined Log Format when
+// l.format is "combined". Handler and duration in seconds are appended.
+//
+func (l *AccessLog) formatCLF(b *bytes.Buffer, e *accessLogEntry) {
+  b.WriteString(e.Remote)
+  b.WriteString(" - ")
+  b.WriteString(clfString(e.User))
+  b.WriteString(" [")
+  b.WriteString(e.Time)
+  b.WriteString("] \"")
+  b.WriteString(clfString(e.Method))
+  b.WriteByte(' ')
+  b.WriteString(clfString(e.URI))
+  b.WriteByte(' ')
+  b.WriteString(clfString(e.Proto))
+  b.WriteString("\" ")
+  b.WriteString(strconv.Itoa(e.Status))
+  b.WriteByte(' ')
+  if e.Bytes == 0 {
+    b.WriteByte('-')
+  } else {
+    b.WriteString(strconv.FormatInt(e.Bytes, 10))
+  }
+  if l.format == "combined" {
+    b.WriteString(" \"")
+    b.WriteString(clfString(e.Referer))
+    b.WriteString("\" \"")
+    b.WriteString(clfString(e.UserAgent))
+    b.WriteByte('"')
+  }
+  b.WriteString(" \"")
+  b.WriteString(clfString(e.Handler))
+  b.WriteString("\" ")
+  b.WriteString(strconv.FormatFloat(e.Duration, 'f', 6, 64))
+  b.WriteByte('\n')
+}
+
+
+// clfString returns "-" for empty strings and s with quotes escaped
+// otherwise.
+//
+func clfString(s string) string {
+  if s == "" {
+    return "-"
+  }
+  q := strconv.Quote(s)
+  return q[1:len(q)-1]
+}
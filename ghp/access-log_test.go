@@ -0,0 +1,69 @@
+package main
+
+import (
+  "bytes"
+  "testing"
+)
+
+
+func TestClfString(t *testing.T) {
+  for _, tc := range []struct {
+    s      string
+    expect string
+  }{
+    { "", "-" },
+    { "curl/7.64", "curl/7.64" },
+    { `a "quoted" b`, `a \"quoted\" b` },
+    { "line\nbreak", `line\nbreak` },
+    { `back\slash`, `back\\slash` },
+    { "\x00", `\x00` },
+  } {
+    if s := clfString(tc.s); s != tc.expect {
+      t.Errorf("%q: %q, expected %q", tc.s, s, tc.expect)
+    }
+  }
+}
+
+
+func TestFormatCLF(t *testing.T) {
+  entry := func(method, uri string) *accessLogEntry {
+    return &accessLogEntry{
+      Time: "10/Oct/2026:13:55:36 +0000",
+      Remote: "192.0.2.1",
+      Method: method,
+      URI: uri,
+      Proto: "HTTP/1.1",
+      Status: 200,
+      Bytes: 2326,
+      Duration: 0.0125,
+      Referer: "https://example.com/",
+      UserAgent: `curl "x"`,
+      Handler: "file",
+    }
+  }
+  for _, tc := range []struct {
+    format string
+    e      *accessLogEntry
+    expect string
+  }{
+    { "common", entry("GET", "/a?b=c"),
+      `192.0.2.1 - - [10/Oct/2026:13:55:36 +0000] "GET /a?b=c HTTP/1.1" 200 2326` +
+      ` "file" 0.012500` + "\n" },
+    { "combined", entry("GET", "/"),
+      `192.0.2.1 - - [10/Oct/2026:13:55:36 +0000] "GET / HTTP/1.1" 200 2326` +
+      ` "https://example.com/" "curl \"x\"" "file" 0.012500` + "\n" },
+    // a request line can't break out of its quotes or the line
+    { "common", entry(`GET"`, "/a\" 200 1 \"x\n"),
+      `192.0.2.1 - - [10/Oct/2026:13:55:36 +0000] "GET\" /a\" 200 1 \"x\n HTTP/1.1"` +
+      ` 200 2326 "file" 0.012500` + "\n" },
+    { "common", &accessLogEntry{ Time: "t", Remote: "::1", User: "u",
+      Method: "HEAD", URI: "/", Proto: "HTTP/2.0", Status: 304 },
+      `::1 - u [t] "HEAD / HTTP/2.0" 304 - "-" 0.000000` + "\n" },
+  } {
+    var b bytes.Buffer
+    (&AccessLog{ format: tc.format }).formatCLF(&b, tc.e)
+    if b.String() != tc.expect {
+      t.Errorf("%s:\n  %s\nexpected\n  %s", tc.format, b.String(), tc.expect)
+    }
+  }
+}
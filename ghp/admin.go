@@ -0,0 +1,378 @@
+package main
+
+import (
+  "encoding/json"
+  "html/template"
+  "net"
+  "net/http"
+  "net/url"
+  "os"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+
+// Admin serves a status page listing servers, servlets and pages, as HTML
+// or JSON, with actions to rebuild or evict cache entries.
+// It is served by a dedicated server, bound to a loopback address or a unix
+// socket. See AdminConfig.
+//
+//   GET  /                          status page. JSON with ?format=json
+//   POST /rebuild?site=N&servlet=S  rebuild servlet S of site N
+//   POST /rebuild?site=N&page=P     rebuild page P (relative filename)
+//   POST /evict?site=N&servlet=S    remove servlet S from cache and stop it
+//   POST /evict?site=N&page=P       remove page P from cache
+//
+type Admin struct {
+  g       *Ghp
+  started time.Time
+}
+
+
+func NewAdmin(g *Ghp) *Admin {
+  return &Admin{ g: g, started: time.Now() }
+}
+
+
+type adminStatus struct {
+  Version string         `json:"version"`
+  Pid     int            `json:"pid"`
+  Started time.Time      `json:"started"`
+  DevMode bool           `json:"dev_mode"`
+  Servers []*adminServer `json:"servers"`
+  Sites   []*adminSite   `json:"sites"`
+}
+
+type adminServer struct {
+  Address     string `json:"address"`
+  Type        string `json:"type"`
+  Connections int    `json:"connections"`  // open, not counting hijacked
+  Hijacked    int    `json:"hijacked"`     // e.g. WebSockets
+}
+
+type adminSite struct {
+  Index    int             `json:"index"`  // for actions. 0 is the default site
+  Name     string          `json:"name"`
+  PubDir   string          `json:"pub_dir"`
+  Servlets []*adminServlet `json:"servlets"`
+  Pages    []*adminPage    `json:"pages"`
+}
+
+type adminServlet struct {
+  Name     string         `json:"name"`
+  Version  string         `json:"version"`
+  Built    time.Time      `json:"built"`
+  Libfile  string         `json:"libfile"`
+  Error    string         `json:"error,omitempty"`
+  Hijacked int            `json:"hijacked"`
+  SrcGraph *adminSrcGraph `json:"src_graph,omitempty"`  // nil without hot-reload
+}
+
+type adminSrcGraph struct {
+  RootDir  string    `json:"root_dir"`
+  Modified time.Time `json:"modified"`  // newest source file
+  Files    int       `json:"files"`
+}
+
+type adminPage struct {
+  Name     string    `json:"name"`  // filename relative to pub-dir
+  Built    time.Time `json:"built"`
+  Parents  []string  `json:"parents,omitempty"`  // nearest first
+  Error    string    `json:"error,omitempty"`
+}
+
+
+func (a *Admin) ServeHTTP(w *HttpResponse, r *http.Request) {
+  w.setHandler("admin", "")
+  w.Header().Set("Cache-Control", "no-store")
+
+  // A web page can make a browser send requests to the admin server with a
+  // DNS name which resolves to a loopback address ("DNS rebinding"), but
+  // not with the loopback Host
+  if !adminHostAllowed(r.Host, a.g.config.Admin.Address) {
+    http.Error(w, "forbidden", http.StatusForbidden)
+    return
+  }
+
+  switch r.URL.Path {
+  case "/":
+    if r.Method != "GET" && r.Method != "HEAD" {
+      a.replyMethodNotAllowed(w, "GET, HEAD")
+      return
+    }
+    a.serveStatus(w, r)
+  case "/rebuild", "/evict":
+    if r.Method != "POST" {
+      a.replyMethodNotAllowed(w, "POST")
+      return
+    }
+    a.serveAction(w, r, r.URL.Path[1:])
+  default:
+    http.Error(w, "not found", http.StatusNotFound)
+  }
+}
+
+
+// adminHostAllowed returns true if host, the Host header of a request to the
+// admin server at address, is a loopback IP address, "localhost" or address
+//
+func adminHostAllowed(host, address string) bool {
+  if host == address || strings.HasPrefix(address, "unix:") {
+    return true  // a unix socket can't be reached from a browser
+  }
+  if h, _, err := net.SplitHostPort(host); err == nil {
+    host = h
+  } else {
+    host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+  }
+  if strings.EqualFold(host, "localhost") {
+    return true
+  }
+  ip := net.ParseIP(host)
+  return ip != nil && ip.IsLoopback()
+}
+
+
+func (a *Admin) replyMethodNotAllowed(w *HttpResponse, allow string) {
+  w.Header().Set("Allow", allow)
+  http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+}
+
+
+func (a *Admin) serveStatus(w *HttpResponse, r *http.Request) {
+  st := a.status()
+
+  if r.URL.Query().Get("format") == "json" ||
+     strings.Contains(r.Header.Get("Accept"), "application/json") {
+    w.Header().Set("Content-Type", "application/json; charset=utf-8")
+    enc := json.NewEncoder(w)
+    enc.SetIndent("", "  ")
+    enc.Encode(st)
+    return
+  }
+
+  t, err := adminTemplate()
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  w.Header().Set("Content-Type", "text/html; charset=utf-8")
+  if err := t.Execute(w, st); err != nil {
+    logf("[admin] template: %v", err)
+  }
+}
+
+
+// serveAction performs action "rebuild" or "evict" on the servlet or page
+// given by the query of r, then redirects to the status page.
+//
+func (a *Admin) serveAction(w *HttpResponse, r *http.Request, action string) {
+  // Forms on other websites can make browsers POST to a loopback address.
+  // Browsers always send Origin for such cross-origin requests.
+  if origin := r.Header.Get("Origin"); origin != "" {
+    if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+      http.Error(w, "cross-origin request denied", http.StatusForbidden)
+      return
+    }
+  }
+
+  if err := r.ParseForm(); err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  sites := a.g.allSites()
+  i, err := strconv.Atoi(r.Form.Get("site"))
+  if err != nil || i < 0 || i >= len(sites) {
+    http.Error(w, "invalid site", http.StatusBadRequest)
+    return
+  }
+  site := sites[i]
+
+  if name := r.Form.Get("servlet"); name != "" {
+    err = a.servletAction(site, action, name)
+  } else if name := r.Form.Get("page"); name != "" {
+    err = a.pageAction(site, action, name)
+  } else {
+    err = errorf("missing servlet or page")
+  }
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+
+  logf("[admin] %s %s %s", action, site, r.Form.Encode())
+  http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+
+func (a *Admin) servletAction(site *Site, action, name string) error {
+  c := site.servletCache
+  if c == nil {
+    return errorf("servlets are disabled for %s", site)
+  }
+  prevs := c.GetCached(name)
+  if prevs == nil {
+    return errorf("servlet %q is not loaded", name)
+  }
+  if action == "evict" {
+    c.Evict(name)
+    return nil
+  }
+  // build errors are shown on the status page
+  c.Build(name, prevs)
+  return nil
+}
+
+
+func (a *Admin) pageAction(site *Site, action, name string) error {
+  c := site.pageCache
+  if c == nil {
+    return errorf("pages are disabled for %s", site)
+  }
+  filename := filepath.Join(site.pubdir, filepath.FromSlash(name))
+  if !c.Evict(filename) {
+    return errorf("page %q is not loaded", name)
+  }
+  if action == "evict" {
+    return nil
+  }
+  f, err := os.Open(filename)
+  if err != nil {
+    return err
+  }
+  defer f.Close()
+  d, err := f.Stat()
+  if err != nil {
+    return err
+  }
+  // build errors are shown on the status page
+  c.Build(&buildCtx{}, f, d)
+  return nil
+}
+
+
+func (a *Admin) status() *adminStatus {
+  st := &adminStatus{
+    Version: ghpVersion,
+    Pid: os.Getpid(),
+    Started: a.started,
+    DevMode: devMode,
+  }
+
+  for _, s := range a.g.servers.httpServers {
+    s.connsmu.Lock()
+    nconns := len(s.conns)
+    s.connsmu.Unlock()
+    st.Servers = append(st.Servers, &adminServer{
+      Address: s.displayAddr(),
+      Type: s.c.Type,
+      Connections: nconns,
+      Hijacked: s.hijacked.Len(),
+    })
+  }
+
+  for i, site := range a.g.allSites() {
+    as := &adminSite{ Index: i, Name: site.String(), PubDir: site.pubdir }
+    if site.servletCache != nil {
+      for _, s := range site.servletCache.Servlets() {
+        as.Servlets = append(as.Servlets, adminServletStatus(s))
+      }
+      sort.Slice(as.Servlets, func(i, j int) bool {
+        return as.Servlets[i].Name < as.Servlets[j].Name
+      })
+    }
+    if site.pageCache != nil {
+      for filename, p := range site.pageCache.Items() {
+        as.Pages = append(as.Pages, adminPageStatus(site, filename, p))
+      }
+      sort.Slice(as.Pages, func(i, j int) bool {
+        return as.Pages[i].Name < as.Pages[j].Name
+      })
+    }
+    st.Sites = append(st.Sites, as)
+  }
+
+  return st
+}
+
+
+func adminServletStatus(s *Servlet) *adminServlet {
+  // builds replace these under the lock of the cache
+  s.cache.itemsmu.RLock()
+  builderr, g := s.builderr, s.srcGraph
+  s.cache.itemsmu.RUnlock()
+
+  as := &adminServlet{
+    Name: s.name,
+    Version: s.ctx.Version(),
+    Built: time.Unix(0, s.version),
+    Libfile: s.libfile,
+    Hijacked: s.conns.Len(),
+  }
+  if builderr != nil {
+    as.Error = builderr.Error()
+  }
+  if g != nil {
+    nfiles := 0
+    g.filemap.Range(func(_, _ interface{}) bool {
+      nfiles++
+      return true
+    })
+    as.SrcGraph = &adminSrcGraph{
+      RootDir: g.rootdir,
+      Modified: time.Unix(0, atomic.LoadInt64(&g.mtime)),
+      Files: nfiles,
+    }
+  }
+  return as
+}
+
+
+func adminPageStatus(site *Site, filename string, p *Page) *adminPage {
+  // pages are built before they're placed in the cache, under its lock
+  p.cache.itemsmu.RLock()
+  mtime, builderr, missing := p.mtime, p.builderr, p.relatedPageMissing
+  var parents []string
+  for pp := p.parent; pp != nil; pp = pp.parent {
+    parents = append(parents, pp.name)
+  }
+  p.cache.itemsmu.RUnlock()
+
+  ap := &adminPage{
+    Name: filepath.ToSlash(relfile(site.pubdir, filename)),
+    Built: time.Unix(0, mtime),
+    Parents: parents,
+  }
+  if builderr != nil {
+    ap.Error = builderr.Error()
+  } else if missing != "" {
+    ap.Error = "missing related page " + missing
+  }
+  return ap
+}
+
+
+var (
+  adminTemplateOnce sync.Once
+  adminTemplateVal  *template.Template
+  adminTemplateErr  error
+)
+
+// adminTemplate returns the template of the status page, misc/admin.html
+//
+func adminTemplate() (*template.Template, error) {
+  adminTemplateOnce.Do(func() {
+    funcs := template.FuncMap{
+      "utcdate": helper_utcdate,
+      "timestamp": helper_timestamp,
+    }
+    filename := pjoin(ghpdir, "misc", "admin.html")
+    adminTemplateVal, adminTemplateErr = template.New("admin.html").Funcs(funcs).ParseFiles(filename)
+  })
+  return adminTemplateVal, adminTemplateErr
+}
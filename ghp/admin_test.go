@@ -0,0 +1,32 @@
+package main
+
+import (
+  "testing"
+)
+
+
+func TestAdminHostAllowed(t *testing.T) {
+  for _, tc := range []struct {
+    host    string
+    address string
+    allowed bool
+  }{
+    { "localhost:8001", "localhost:8001", true },
+    { "localhost", "127.0.0.1:8001", true },
+    { "LocalHost:8001", "127.0.0.1:8001", true },
+    { "127.0.0.1:8001", "127.0.0.1:8001", true },
+    { "127.0.0.2", "127.0.0.1:8001", true },
+    { "[::1]:8001", "[::1]:8001", true },
+    { "[::1]", "127.0.0.1:8001", true },
+    { "evil.example.com:8001", "127.0.0.1:8001", false },
+    { "localhost.example.com", "127.0.0.1:8001", false },
+    { "192.168.1.2:8001", "127.0.0.1:8001", false },
+    { "", "127.0.0.1:8001", false },
+    { "evil.example.com", "unix:/run/ghp-admin.sock", true },
+  } {
+    if allowed := adminHostAllowed(tc.host, tc.address); allowed != tc.allowed {
+      t.Errorf("%q (admin %s): allowed=%v, expected %v",
+        tc.host, tc.address, allowed, tc.allowed)
+    }
+  }
+}
@@ -2,9 +2,7 @@ package main
 
 import (
   "os"
-  "os/signal"
   "sync"
-  "syscall"
 )
 
 var (
@@ -12,22 +10,17 @@ var (
   atExitFuns []func()
 )
 
+// AtExit registers fn to be called by Exit
+//
 func AtExit(fn func()) {
   atExitLock.Lock()
   defer atExitLock.Unlock()
-  if len(atExitFuns) == 0 {
-    sigch := make(chan os.Signal, 2)
-    signal.Notify(sigch, syscall.SIGINT, syscall.SIGTERM)
-    go atExitHandler(sigch)
-  }
   atExitFuns = append(atExitFuns, fn)
 }
 
 // Exit runs any registered exit functions in the inverse order they were
 // registered and then exits with the specified status.
-func atExitHandler(ch chan os.Signal) {
-  <-ch  // await signal
-
+func Exit(status int) {
   runfn := func(fn func()) {
     defer func() {
       if err := recover(); err != nil {
@@ -41,5 +34,5 @@ func atExitHandler(ch chan os.Signal) {
   for i := len(atExitFuns) - 1; i >= 0; i-- {
     runfn(atExitFuns[i])
   }
-  os.Exit(1)
+  os.Exit(status)
 }
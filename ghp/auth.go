@@ -0,0 +1,149 @@
+package main
+
+import (
+  "bufio"
+  "crypto/sha1"
+  "crypto/subtle"
+  "encoding/base64"
+  "net/http"
+  "os"
+  "strings"
+  "sync"
+
+  "github.com/rsms/ghp"
+  "golang.org/x/crypto/bcrypt"
+)
+
+
+// Htpasswd is a password file in the format of Apache's htpasswd, with
+// lines of "user:hash". Supported hashes are bcrypt ("$2y$...") and SHA-1
+// ("{SHA}..."). The file is reloaded when it changes.
+//
+type Htpasswd struct {
+  filename string
+  mu       sync.RWMutex
+  mtime    int64
+  users    map[string]string  // username => hash
+}
+
+
+func NewHtpasswd(filename string) *Htpasswd {
+  return &Htpasswd{ filename: filename, mtime: -1 }
+}
+
+
+// Authenticate returns true if user exists and password matches
+//
+func (h *Htpasswd) Authenticate(user, password string) bool {
+  if err := h.loadIfChanged(); err != nil {
+    logf("[auth] %v", err)
+    return false
+  }
+  h.mu.RLock()
+  hash, ok := h.users[user]
+  h.mu.RUnlock()
+  if !ok {
+    return false
+  }
+  return checkPasswordHash(hash, password)
+}
+
+
+func (h *Htpasswd) loadIfChanged() error {
+  d, err := os.Stat(h.filename)
+  if err != nil {
+    return err
+  }
+  mtime := d.ModTime().UnixNano()
+  h.mu.RLock()
+  changed := mtime != h.mtime
+  h.mu.RUnlock()
+  if !changed {
+    return nil
+  }
+
+  f, err := os.Open(h.filename)
+  if err != nil {
+    return err
+  }
+  defer f.Close()
+
+  users := make(map[string]string)
+  s := bufio.NewScanner(f)
+  lineno := 0
+  for s.Scan() {
+    lineno++
+    line := strings.TrimSpace(s.Text())
+    if line == "" || line[0] == '#' {
+      continue
+    }
+    i := strings.IndexByte(line, ':')
+    if i < 1 {
+      return errorf("%s:%d: malformed line", h.filename, lineno)
+    }
+    user, hash := line[:i], line[i+1:]
+    if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+      logf("[auth] %s:%d: unsupported hash for user %q (use bcrypt or SHA)",
+        h.filename, lineno, user)
+      continue
+    }
+    users[user] = hash
+  }
+  if err := s.Err(); err != nil {
+    return err
+  }
+
+  h.mu.Lock()
+  h.users = users
+  h.mtime = mtime
+  h.mu.Unlock()
+  return nil
+}
+
+
+func checkPasswordHash(hash, password string) bool {
+  if strings.HasPrefix(hash, "{SHA}") {
+    sum := sha1.Sum([]byte(password))
+    expect := base64.StdEncoding.EncodeToString(sum[:])
+    return subtle.ConstantTimeCompare([]byte(hash[len("{SHA}"):]), []byte(expect)) == 1
+  }
+  return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// ---------------------------------------------------------------------------
+
+// authRule returns the first auth rule of the site matching urlpath, or nil
+//
+func (s *Site) authRule(urlpath string) *AuthConfig {
+  for _, ac := range s.c.Auth {
+    if _, ok := ac.pattern.Match(urlpath); ok {
+      return ac
+    }
+  }
+  return nil
+}
+
+
+// authorize enforces the first auth rule of the site matching urlpath,
+// responding with "401 Unauthorized" when credentials are missing or wrong.
+// urlpath is the request path, or the pub-dir path of the resource which
+// serves it, e.g. "/secret.html" for the clean URL "/secret".
+// On success, the username is recorded in st.
+// Returns false if the request was responded to.
+//
+func (s *HttpServer) authorize(w *HttpResponse, r *http.Request, st *ghp.RequestState, urlpath string) bool {
+  ac := w.site.authRule(urlpath)
+  root := w.root()
+  if ac == nil || ac == root.authorized {
+    return true
+  }
+  user, password, ok := r.BasicAuth()
+  if ok && ac.htpasswd.Authenticate(user, password) {
+    st.User = user
+    root.authorized = ac
+    return true
+  }
+  w.Header().Set("WWW-Authenticate", "Basic realm=\"" + ac.Realm + "\", charset=\"UTF-8\"")
+  s.replyStatus(w, http.StatusUnauthorized, nil)
+  return false
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+  "crypto/sha1"
+  "encoding/base64"
+  "io/ioutil"
+  "net/http"
+  "os"
+  "testing"
+
+  "golang.org/x/crypto/bcrypt"
+)
+
+
+// writeTestHtpasswd writes an htpasswd file with user "u" and password
+// "pw", and returns its filename
+//
+func writeTestHtpasswd(t *testing.T) string {
+  sum := sha1.Sum([]byte("pw"))
+  f, err := ioutil.TempFile("", "ghp-htpasswd")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer f.Close()
+  f.WriteString("# comment\n\nu:{SHA}" + base64.StdEncoding.EncodeToString(sum[:]) + "\n")
+  return f.Name()
+}
+
+
+func TestHtpasswd(t *testing.T) {
+  filename := writeTestHtpasswd(t)
+  defer os.Remove(filename)
+  h := NewHtpasswd(filename)
+
+  for _, tc := range []struct {
+    user, password string
+    ok bool
+  }{
+    { "u", "pw", true },
+    { "u", "wrong", false },
+    { "u", "", false },
+    { "nobody", "pw", false },
+    { "", "", false },
+  } {
+    if ok := h.Authenticate(tc.user, tc.password); ok != tc.ok {
+      t.Errorf("Authenticate(%q, %q) = %v, expected %v", tc.user, tc.password, ok, tc.ok)
+    }
+  }
+}
+
+
+func TestHtpasswdMalformed(t *testing.T) {
+  f, err := ioutil.TempFile("", "ghp-htpasswd")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.Remove(f.Name())
+  f.WriteString("no-colon\n")
+  f.Close()
+  if NewHtpasswd(f.Name()).loadIfChanged() == nil {
+    t.Errorf("expected error for malformed line")
+  }
+}
+
+
+func TestCheckPasswordHash(t *testing.T) {
+  bhash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+  if err != nil {
+    t.Fatal(err)
+  }
+  for _, tc := range []struct {
+    hash, password string
+    ok bool
+  }{
+    // "htpasswd -s" of "secret"
+    { "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "secret", true },
+    { "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "Secret", false },
+    { string(bhash), "secret", true },
+    { string(bhash), "secreT", false },
+    { "$2y$05$malformed", "secret", false },
+  } {
+    if ok := checkPasswordHash(tc.hash, tc.password); ok != tc.ok {
+      t.Errorf("checkPasswordHash(%q, %q) = %v, expected %v", tc.hash, tc.password, ok, tc.ok)
+    }
+  }
+}
+
+
+// TestAuthResolvedPath checks that auth rules apply to the file serving a
+// request, not only to the request path
+//
+func TestAuthResolvedPath(t *testing.T) {
+  htpasswd := writeTestHtpasswd(t)
+  defer os.Remove(htpasswd)
+
+  s, cleanup := newTestServer(t, map[string]string{
+    "index.html": "home",
+    "secret.html": "secret",
+    "private/index.html": "private",
+    "app/.ghp.yaml": "fallback: /private/index.html\n",
+    "dir/index.html": "index",
+  }, `
+pages:
+  enabled: true
+clean-urls:
+  enabled: true
+auth:
+  - match: /secret.html
+    htpasswd: ` + htpasswd + `
+  - match: /private/
+    htpasswd: ` + htpasswd + `
+  - match: /dir/index.html
+    htpasswd: ` + htpasswd + `
+`)
+  defer cleanup()
+
+  for _, tc := range []struct {
+    urlpath  string
+    password string
+    status   int
+  }{
+    { "/", "", http.StatusOK },
+    { "/secret.html", "", http.StatusUnauthorized },
+    { "/secret", "", http.StatusUnauthorized },  // clean URL
+    { "/secret", "wrong", http.StatusUnauthorized },
+    { "/secret", "pw", http.StatusOK },
+    { "/app/some/route", "", http.StatusUnauthorized },  // fallback
+    { "/app/some/route", "pw", http.StatusOK },
+    { "/dir/", "", http.StatusUnauthorized },  // index file
+    { "/dir/", "pw", http.StatusOK },
+  } {
+    w := testGet(s, tc.urlpath, tc.password)
+    expectStatus(t, w, tc.urlpath, tc.status)
+    if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+      t.Errorf("GET %s: missing WWW-Authenticate header", tc.urlpath)
+    }
+  }
+}
+
+
+func TestAuthUncleanPath(t *testing.T) {
+  htpasswd := writeTestHtpasswd(t)
+  defer os.Remove(htpasswd)
+
+  s, cleanup := newTestServer(t, map[string]string{
+    "backend/admin/users": "users",
+  }, `
+servers:
+  - address: localhost:0
+    type: http
+    routes:
+      - match: /api/{p...}
+        rewrite: /backend/{p}
+auth:
+  - match: /api/admin/
+    htpasswd: ` + htpasswd + `
+`)
+  defer cleanup()
+
+  for _, tc := range []struct {
+    urlpath  string
+    password string
+    status   int
+  }{
+    { "/api/admin/users", "", http.StatusUnauthorized },
+    { "/api//admin/users", "", http.StatusUnauthorized },
+    { "/api/x/../admin/users", "", http.StatusUnauthorized },
+    { "/api/./admin/users", "", http.StatusUnauthorized },
+    { "/api//admin/users", "pw", http.StatusOK },
+  } {
+    w := testGet(s, tc.urlpath, tc.password)
+    expectStatus(t, w, tc.urlpath, tc.status)
+  }
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+  "net"
+  "net/http"
+  "strings"
+)
+
+
+// TrustedProxies is a set of addresses of reverse proxies whose
+// X-Forwarded-For and Forwarded headers are trusted
+//
+type TrustedProxies struct {
+  nets []*net.IPNet
+  unix bool  // trust peers on unix sockets
+}
+
+
+// ParseTrustedProxies parses a list of IP addresses, CIDR ranges like
+// "10.0.0.0/8", and "unix" for peers on unix sockets
+//
+func ParseTrustedProxies(addrs []string) (*TrustedProxies, error) {
+  t := &TrustedProxies{}
+  for _, addr := range addrs {
+    if addr == "unix" {
+      t.unix = true
+      continue
+    }
+    if strings.IndexByte(addr, '/') == -1 {
+      ip := net.ParseIP(addr)
+      if ip == nil {
+        return nil, errorf("invalid trusted proxy address %q", addr)
+      }
+      bits := 8 * net.IPv6len
+      if ip4 := ip.To4(); ip4 != nil {
+        ip, bits = ip4, 8 * net.IPv4len
+      }
+      t.nets = append(t.nets, &net.IPNet{ IP: ip, Mask: net.CIDRMask(bits, bits) })
+      continue
+    }
+    _, ipnet, err := net.ParseCIDR(addr)
+    if err != nil {
+      return nil, errorf("invalid trusted proxy range %q", addr)
+    }
+    t.nets = append(t.nets, ipnet)
+  }
+  return t, nil
+}
+
+
+// Contains returns true if host, an IP address or a unix socket peer like
+// "@1", is a trusted proxy
+//
+func (t *TrustedProxies) Contains(host string) bool {
+  if strings.HasPrefix(host, "@") {
+    return t.unix
+  }
+  ip := net.ParseIP(host)
+  if ip == nil {
+    return false
+  }
+  for _, n := range t.nets {
+    if n.Contains(ip) {
+      return true
+    }
+  }
+  return false
+}
+
+
+// ClientIP returns the IP address of the client of r. When the peer is a
+// trusted proxy, this is the nearest untrusted address in the Forwarded or
+// X-Forwarded-For header.
+//
+func (t *TrustedProxies) ClientIP(r *http.Request) string {
+  host := remoteHost(r)
+  if t == nil || !t.Contains(host) {
+    return host
+  }
+  hops := forwardedFor(r.Header)
+  for i := len(hops) - 1; i >= 0; i-- {
+    hop := hops[i]
+    if net.ParseIP(hop) == nil {
+      break  // e.g. "unknown" or an obfuscated identifier
+    }
+    host = hop
+    if !t.Contains(hop) {
+      break
+    }
+  }
+  return host
+}
+
+
+// forwardedFor returns the client addresses in the Forwarded header, or if
+// there's none, the X-Forwarded-For header, nearest proxy last
+//
+func forwardedFor(h http.Header) []string {
+  var hops []string
+  if values := h["Forwarded"]; len(values) > 0 {
+    // e.g. `for=192.0.2.43, for="[2001:db8:cafe::17]:4711";proto=http`
+    for _, v := range values {
+      for _, elem := range strings.Split(v, ",") {
+        for _, pair := range strings.Split(elem, ";") {
+          pair = strings.TrimSpace(pair)
+          if len(pair) > 4 && strings.EqualFold(pair[:4], "for=") {
+            hops = append(hops, forwardedNode(pair[4:]))
+          }
+        }
+      }
+    }
+    return hops
+  }
+  for _, v := range h["X-Forwarded-For"] {
+    for _, hop := range strings.Split(v, ",") {
+      hops = append(hops, strings.TrimSpace(hop))
+    }
+  }
+  return hops
+}
+
+
+// forwardedNode returns the IP address of a node of a Forwarded header,
+// like `192.0.2.43`, `"192.0.2.43:47011"` or `"[2001:db8:cafe::17]:4711"`
+//
+func forwardedNode(node string) string {
+  node = strings.Trim(node, `"`)
+  if strings.HasPrefix(node, "[") {
+    if i := strings.IndexByte(node, ']'); i != -1 {
+      return node[1:i]
+    }
+  } else if i := strings.IndexByte(node, ':'); i != -1 {
+    return node[:i]
+  }
+  return node
+}
+
+
+// remoteHost returns the host of r.RemoteAddr, without port
+//
+func remoteHost(r *http.Request) string {
+  if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+    return host
+  }
+  return r.RemoteAddr
+}
+
+
+// clientIP returns the IP address of the client of r, as resolved by the
+// server for requests with GHP state, or the host of r.RemoteAddr
+//
+func clientIP(r *http.Request) string {
+  if st := requestState(r); st != nil && st.ClientIP != "" {
+    return st.ClientIP
+  }
+  return remoteHost(r)
+}
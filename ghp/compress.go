@@ -0,0 +1,429 @@
+package main
+
+import (
+  "bufio"
+  "compress/gzip"
+  "io"
+  "mime"
+  "net"
+  "net/http"
+  "os"
+  "strconv"
+  "strings"
+  "sync"
+
+  "github.com/andybalholm/brotli"
+)
+
+
+// file name extensions of precompressed files, keyed by content encoding
+var precompressedExt = map[string]string{
+  "br":   ".br",
+  "gzip": ".gz",
+}
+
+
+// negotiateEncoding returns the first of encodings which is acceptable
+// according to acceptEncoding, the value of a Accept-Encoding header.
+// Returns "" if none is acceptable.
+//
+func negotiateEncoding(acceptEncoding string, encodings []string) string {
+  if acceptEncoding == "" {
+    return ""
+  }
+  accepted := make(map[string]bool)
+  for _, v := range strings.Split(acceptEncoding, ",") {
+    v = strings.TrimSpace(v)
+    name := v
+    if i := strings.IndexByte(v, ';'); i != -1 {
+      name = strings.TrimSpace(v[:i])
+      if q, ok := parseQValue(v[i+1:]); ok && q == 0 {
+        accepted[strings.ToLower(name)] = false
+        continue
+      }
+    }
+    accepted[strings.ToLower(name)] = true
+  }
+  for _, enc := range encodings {
+    if ok, found := accepted[enc]; found {
+      if ok {
+        return enc
+      }
+    } else if accepted["*"] {
+      return enc
+    }
+  }
+  return ""
+}
+
+
+// parseQValue parses the "q=N" parameter of a header value
+//
+func parseQValue(params string) (float64, bool) {
+  for _, p := range strings.Split(params, ";") {
+    p = strings.TrimSpace(p)
+    if strings.HasPrefix(p, "q=") {
+      q, err := strconv.ParseFloat(p[2:], 64)
+      return q, err == nil
+    }
+  }
+  return 0, false
+}
+
+
+// compressibleType returns true if contentType matches any of patterns,
+// e.g. "text/*" or "application/json".
+//
+func compressibleType(contentType string, patterns []string) bool {
+  mediatype := contentType
+  if i := strings.IndexByte(mediatype, ';'); i != -1 {
+    mediatype = mediatype[:i]
+  }
+  mediatype = strings.ToLower(strings.TrimSpace(mediatype))
+  for _, pattern := range patterns {
+    if strings.HasSuffix(pattern, "/*") {
+      if strings.HasPrefix(mediatype, pattern[:len(pattern)-1]) {
+        return true
+      }
+    } else if mediatype == pattern {
+      return true
+    }
+  }
+  return false
+}
+
+
+// openPrecompressed looks for a precompressed sibling of file fspath, e.g.
+// "foo.css.br" for "foo.css", acceptable by the client.
+// Returns the open file, its info and content encoding on success.
+//
+func openPrecompressed(fspath string, d os.FileInfo, r *http.Request, c *CompressionConfig) (*os.File, os.FileInfo, string) {
+  acceptEncoding := r.Header.Get("Accept-Encoding")
+  if acceptEncoding == "" {
+    return nil, nil, ""
+  }
+  for _, enc := range c.Encodings {
+    if negotiateEncoding(acceptEncoding, []string{enc}) == "" {
+      continue
+    }
+    f, err := os.Open(fspath + precompressedExt[enc])
+    if err != nil {
+      continue
+    }
+    cd, err := f.Stat()
+    if err != nil || !cd.Mode().IsRegular() || cd.ModTime().Before(d.ModTime()) {
+      // unreadable or older than the uncompressed file
+      f.Close()
+      continue
+    }
+    return f, cd, enc
+  }
+  return nil, nil, ""
+}
+
+
+// servePrecompressedFile serves a precompressed variant of file f, if
+// there is one which is acceptable by the client. Returns false if nothing
+// was served.
+//
+func (s *HttpServer) servePrecompressedFile(f *os.File, d os.FileInfo, w *HttpResponse, r *http.Request) bool {
+  c := &s.g.config.Compression
+  if !c.Enabled || !c.Precompressed {
+    return false
+  }
+  cf, cd, enc := openPrecompressed(f.Name(), d, r, c)
+  if cf == nil {
+    return false
+  }
+  defer cf.Close()
+  header := w.Header()
+  if ctype := mime.TypeByExtension(strings.ToLower(pathExt(d.Name()))); ctype != "" {
+    header.Set("Content-Type", ctype)
+  }
+  header.Set("Content-Encoding", enc)
+  addVary(header, "Accept-Encoding")
+  http.ServeContent(w, r, d.Name(), cd.ModTime(), cf)
+  return true
+}
+
+
+// addVary adds name to the Vary header, unless it's already there
+//
+func addVary(header http.Header, name string) {
+  for _, v := range header["Vary"] {
+    for _, s := range strings.Split(v, ",") {
+      if strings.EqualFold(strings.TrimSpace(s), name) {
+        return
+      }
+    }
+  }
+  header.Add("Vary", name)
+}
+
+
+// pathExt returns the file name extension of name, including the dot
+//
+func pathExt(name string) string {
+  if i := strings.LastIndexByte(name, '.'); i != -1 {
+    return name[i:]
+  }
+  return ""
+}
+
+// ---------------------------------------------------------------------------
+
+var gzipWriterPool sync.Pool
+
+const (
+  compressUndecided = iota
+  compressActive
+  compressPassthrough
+)
+
+
+// compressResponseWriter compresses a response on the fly.
+// Data is buffered until at least MinSize bytes have been written, or
+// until the response is flushed, before deciding whether to compress.
+// Responses of compressible types get "Vary: Accept-Encoding", whether
+// they are compressed or not.
+// Responses to HEAD requests get the header of the GET response, as far as
+// it can be known without a body.
+// Close must be called when the response is complete.
+//
+type compressResponseWriter struct {
+  http.ResponseWriter
+  c        *CompressionConfig
+  encoding string  // content encoding, e.g. "gzip". "" to only set Vary
+  head     bool    // response to a HEAD request
+  state    int
+  status   int     // status code passed to WriteHeader. 0 if not called
+  buf      []byte  // buffered data while undecided
+  cw       io.WriteCloser  // compressor. non-nil when state=compressActive
+}
+
+
+func newCompressResponseWriter(w http.ResponseWriter, c *CompressionConfig, encoding string, head bool) *compressResponseWriter {
+  return &compressResponseWriter{
+    ResponseWriter: w,
+    c: c,
+    encoding: encoding,
+    head: head,
+  }
+}
+
+
+func (w *compressResponseWriter) WriteHeader(status int) {
+  if w.state != compressUndecided || w.status != 0 {
+    w.ResponseWriter.WriteHeader(status)
+    return
+  }
+  w.status = status
+  if !w.canCompress() {
+    w.passthrough()
+  } else if w.decidable() {
+    w.decide()
+  }
+  // else: header is written once we have decided
+}
+
+
+// decidable returns true if the response can be decided on before any
+// data is written: there will be no body, or nothing is to be compressed,
+// and the content type is known.
+//
+func (w *compressResponseWriter) decidable() bool {
+  return (w.head || w.encoding == "") && w.Header().Get("Content-Type") != ""
+}
+
+
+func (w *compressResponseWriter) Write(b []byte) (int, error) {
+  switch w.state {
+  case compressActive:
+    return w.cw.Write(b)
+  case compressPassthrough:
+    return w.ResponseWriter.Write(b)
+  }
+
+  if w.status == 0 {
+    w.status = http.StatusOK
+    if !w.canCompress() {
+      w.passthrough()
+      return w.ResponseWriter.Write(b)
+    }
+    if w.decidable() {
+      if err := w.decide(); err != nil {
+        return 0, err
+      }
+      return w.Write(b)
+    }
+  }
+
+  w.buf = append(w.buf, b...)
+  if len(w.buf) >= w.c.MinSize {
+    if err := w.decide(); err != nil {
+      return 0, err
+    }
+  }
+  return len(b), nil
+}
+
+
+func (w *compressResponseWriter) Flush() {
+  if w.state == compressUndecided && w.status != 0 {
+    // Response is streamed. Length is unknown so we ignore MinSize.
+    if w.decide() != nil {
+      return
+    }
+  }
+  if w.state == compressActive {
+    if f, ok := w.cw.(interface{ Flush() error }); ok {
+      f.Flush()
+    }
+  }
+  if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+    flusher.Flush()
+  }
+}
+
+
+// Hijack passes the connection through uncompressed.
+// Implements http.Hijacker
+//
+func (w *compressResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+  hj, ok := w.ResponseWriter.(http.Hijacker)
+  if !ok {
+    return nil, nil, errorf("connection does not support hijacking")
+  }
+  w.state = compressPassthrough
+  w.buf = nil
+  return hj.Hijack()
+}
+
+
+// Close completes the response, writing any buffered data
+//
+func (w *compressResponseWriter) Close() error {
+  switch w.state {
+  case compressActive:
+    err := w.cw.Close()
+    if gz, ok := w.cw.(*gzip.Writer); ok {
+      gzipWriterPool.Put(gz)
+    }
+    w.cw = nil
+    w.state = compressPassthrough
+    return err
+  case compressUndecided:
+    if w.status != 0 {
+      // smaller than MinSize
+      w.passthrough()
+    }
+  }
+  return nil
+}
+
+
+// canCompress returns false if the response can't be compressed based on
+// its status and header.
+//
+func (w *compressResponseWriter) canCompress() bool {
+  if w.status < 200 ||
+     w.status == http.StatusNoContent ||
+     w.status == http.StatusPartialContent ||
+     w.status == http.StatusNotModified {
+    return false
+  }
+  header := w.Header()
+  if header.Get("Content-Encoding") != "" ||
+     header.Get("Content-Range") != "" ||
+     strings.Contains(header.Get("Cache-Control"), "no-transform") {
+    return false
+  }
+  if cl := header.Get("Content-Length"); cl != "" {
+    if n, err := strconv.Atoi(cl); err == nil && n < w.c.MinSize {
+      return false
+    }
+  }
+  if ct := header.Get("Content-Type"); ct != "" {
+    return compressibleType(ct, w.c.Types)
+  }
+  return true
+}
+
+
+// decide starts compression if the content type allows it, or else
+// passes the response through as-is.
+//
+func (w *compressResponseWriter) decide() error {
+  header := w.Header()
+  ct := header.Get("Content-Type")
+  if ct == "" {
+    if len(w.buf) == 0 {
+      w.passthrough()
+      return nil
+    }
+    ct = http.DetectContentType(w.buf)
+    header.Set("Content-Type", ct)
+  }
+  if !compressibleType(ct, w.c.Types) || w.encoding == "" {
+    w.passthrough()
+    return nil
+  }
+
+  header.Del("Content-Length")
+  header.Set("Content-Encoding", w.encoding)
+  addVary(header, "Accept-Encoding")
+  w.ResponseWriter.WriteHeader(w.status)
+  if w.head {
+    w.state = compressPassthrough  // net/http discards any body
+    w.buf = nil
+    return nil
+  }
+
+  switch w.encoding {
+  case "br":
+    w.cw = brotli.NewWriterLevel(w.ResponseWriter, brotli.DefaultCompression)
+  default:
+    if gz, ok := gzipWriterPool.Get().(*gzip.Writer); ok {
+      gz.Reset(w.ResponseWriter)
+      w.cw = gz
+    } else {
+      gz, err := gzip.NewWriterLevel(w.ResponseWriter, gzip.DefaultCompression)
+      if err != nil {
+        return err
+      }
+      w.cw = gz
+    }
+  }
+  w.state = compressActive
+
+  buf := w.buf
+  w.buf = nil
+  _, err := w.cw.Write(buf)
+  return err
+}
+
+
+// passthrough writes the header and any buffered data, and makes any
+// further writes bypass compression.
+//
+func (w *compressResponseWriter) passthrough() {
+  w.state = compressPassthrough
+  header := w.Header()
+  if header.Get("Content-Encoding") == "" && header.Get("Content-Range") == "" {
+    ct := header.Get("Content-Type")
+    if ct == "" && len(w.buf) > 0 {
+      ct = http.DetectContentType(w.buf)  // as net/http will
+    }
+    if ct != "" && compressibleType(ct, w.c.Types) {
+      addVary(header, "Accept-Encoding")
+    }
+  }
+  if w.status != 0 {
+    w.ResponseWriter.WriteHeader(w.status)
+  }
+  if len(w.buf) > 0 {
+    buf := w.buf
+    w.buf = nil
+    w.ResponseWriter.Write(buf)
+  }
+}
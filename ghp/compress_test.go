@@ -0,0 +1,110 @@
+package main
+
+import (
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+)
+
+
+func TestNegotiateEncoding(t *testing.T) {
+  encodings := []string{ "br", "gzip" }
+  for _, tc := range []struct {
+    accept string
+    expect string
+  }{
+    { "", "" },
+    { "gzip", "gzip" },
+    { "gzip, br", "br" },
+    { "GZIP", "gzip" },
+    { "br;q=0, gzip", "gzip" },
+    { "br;q=0.5, gzip;q=1", "br" },  // our preference wins
+    { "*", "br" },
+    { "*, br;q=0", "gzip" },
+    { "identity", "" },
+    { "deflate", "" },
+  } {
+    if enc := negotiateEncoding(tc.accept, encodings); enc != tc.expect {
+      t.Errorf("%q: %q, expected %q", tc.accept, enc, tc.expect)
+    }
+  }
+}
+
+
+func TestCompressibleType(t *testing.T) {
+  types := []string{ "text/*", "application/json" }
+  for _, tc := range []struct {
+    ctype  string
+    expect bool
+  }{
+    { "text/html", true },
+    { "text/html; charset=utf-8", true },
+    { "Text/CSS", true },
+    { "application/json", true },
+    { "application/json+x", false },
+    { "image/png", false },
+    { "", false },
+  } {
+    if ok := compressibleType(tc.ctype, types); ok != tc.expect {
+      t.Errorf("%q: %v, expected %v", tc.ctype, ok, tc.expect)
+    }
+  }
+}
+
+
+func TestCompressResponse(t *testing.T) {
+  s, cleanup := newTestServer(t, map[string]string{
+    "big.html": "<p>" + strings.Repeat("hello ", 500) + "</p>",
+    "small.html": "<p>hello</p>",
+    "image.png": strings.Repeat("x", 2000),
+  }, `
+compression:
+  enabled: true
+  encodings: [gzip]
+  min-size: 1024
+  types: [text/*]
+`)
+  defer cleanup()
+
+  do := func(method, urlpath, accept string) http.Header {
+    r := httptest.NewRequest(method, urlpath, nil)
+    if accept != "" {
+      r.Header.Set("Accept-Encoding", accept)
+    }
+    w := httptest.NewRecorder()
+    s.ServeHTTP(w, r)
+    if w.Code != http.StatusOK {
+      t.Errorf("%s %s: status %d", method, urlpath, w.Code)
+    }
+    return w.Header()
+  }
+
+  for _, tc := range []struct {
+    urlpath  string
+    accept   string
+    encoding string
+    vary     bool
+  }{
+    { "/big.html", "gzip", "gzip", true },
+    { "/big.html", "", "", true },
+    { "/big.html", "br", "", true },
+    { "/small.html", "gzip", "", true },
+    { "/image.png", "gzip", "", false },
+  } {
+    for _, method := range []string{ "GET", "HEAD" } {
+      h := do(method, tc.urlpath, tc.accept)
+      if enc := h.Get("Content-Encoding"); enc != tc.encoding {
+        t.Errorf("%s %s %q: Content-Encoding %q, expected %q",
+          method, tc.urlpath, tc.accept, enc, tc.encoding)
+      }
+      if vary := h.Get("Vary") == "Accept-Encoding"; vary != tc.vary {
+        t.Errorf("%s %s %q: Vary %q", method, tc.urlpath, tc.accept, h.Get("Vary"))
+      }
+      if tc.encoding != "" && h.Get("Content-Length") != "" {
+        t.Errorf("%s %s %q: Content-Length of compressed response",
+          method, tc.urlpath, tc.accept)
+      }
+    }
+  }
+}
@@ -4,9 +4,13 @@ import (
   "bytes"
   "io"
   "io/ioutil"
+  "net"
   "os"
+  "os/user"
+  "strconv"
   "strings"
   "regexp"
+  "time"
 
   "gopkg.in/yaml.v2"
 )
@@ -15,6 +19,18 @@ type GhpConfig struct {
   CacheDir string            `yaml:"cache-dir"`
   PubDir   string            `yaml:"pub-dir"`
   Servers  []*ServerConfig
+  Sites    []*SiteConfig `yaml:",omitempty"`
+  Deny     []string  // private files, added to defaultDeny. See FileFilter
+  Allow    []string  // exceptions to Deny, added to defaultAllow
+  Index    []string `yaml:",omitempty"`  // index file names, in order of preference
+  CleanUrls CleanUrlsConfig `yaml:"clean-urls"`
+  Auth     []*AuthConfig `yaml:",omitempty"`  // of PubDir. Sites have their own
+  AccessLog AccessLogConfig `yaml:"access-log"`
+  Compression CompressionConfig
+  Metrics  MetricsConfig
+  Admin    AdminConfig
+  Health   HealthConfig
+  Shutdown ShutdownConfig
   Zdr      ZdrConfig
   Servlet  ServletConfig
   Pages    PagesConfig
@@ -22,12 +38,63 @@ type GhpConfig struct {
 }
 
 func (c *GhpConfig) onLoad() error {
+  if err := checkFilePatterns(c.Deny); err != nil {
+    return err
+  }
+  if err := checkFilePatterns(c.Allow); err != nil {
+    return err
+  }
+
+  if err := checkIndexNames(c.Index); err != nil {
+    return err
+  }
+
+  if err := c.CleanUrls.onLoad(); err != nil {
+    return err
+  }
+
   for _, sc := range c.Servers {
     if err := sc.onLoad(); err != nil {
       return err
     }
   }
 
+  for _, ac := range c.Auth {
+    if err := ac.onLoad(); err != nil {
+      return err
+    }
+  }
+
+  for _, sc := range c.Sites {
+    if err := sc.onLoad(); err != nil {
+      return err
+    }
+  }
+
+  if err := c.AccessLog.onLoad(); err != nil {
+    return err
+  }
+
+  if err := c.Compression.onLoad(); err != nil {
+    return err
+  }
+
+  if err := c.Metrics.onLoad(); err != nil {
+    return err
+  }
+
+  if err := c.Admin.onLoad(); err != nil {
+    return err
+  }
+
+  if err := c.Health.onLoad(); err != nil {
+    return err
+  }
+
+  if err := c.Shutdown.onLoad(); err != nil {
+    return err
+  }
+
   if err := c.Zdr.onLoad(); err != nil {
     return err
   }
@@ -49,12 +116,50 @@ type ServerType = string
 // }
 
 type ServerConfig struct {
-  Address     string
-  Type        ServerType // http, https
+  Address     string     // "host:port" or "unix:/path/to/socket"
+  Type        ServerType // http, https, h2c
   TlsCertFile string `yaml:"tls-cert-file,omitempty"`
   TlsKeyFile  string `yaml:"tls-key-file,omitempty"`
   Autocert    *AutocertConfig `yaml:",omitempty"`
   DirList     DirListConfig
+  Routes      []*RouteConfig `yaml:",omitempty"`
+  Deny        []string `yaml:",omitempty"`  // added to GhpConfig.Deny
+  Allow       []string `yaml:",omitempty"`  // added to GhpConfig.Allow
+  RateLimits  []*RateLimitConfig `yaml:"rate-limits,omitempty"`
+
+  // Client addresses. See TrustedProxies
+  ProxyProtocol  bool     `yaml:"proxy-protocol,omitempty"`   // expect PROXY headers
+  TrustedProxies []string `yaml:"trusted-proxies,omitempty"`  // e.g. "10.0.0.0/8"
+
+  // Timeouts. Defaults are used when not set. 0 means no timeout.
+  ReadTimeout  *time.Duration `yaml:"read-timeout,omitempty"`   // default 10s
+  WriteTimeout *time.Duration `yaml:"write-timeout,omitempty"`  // default 10s
+  IdleTimeout  *time.Duration `yaml:"idle-timeout,omitempty"`   // default none
+
+  // Limits. 0 means no limit.
+  MaxConnections int `yaml:"max-connections,omitempty"`  // open connections
+  MaxRequests    int `yaml:"max-requests,omitempty"`     // requests in flight
+  QueueTimeout   *time.Duration `yaml:"queue-timeout,omitempty"`  // default 1s
+  MaxBodySize    int64 `yaml:"max-body-size,omitempty"`  // request body bytes
+
+  // Permissions and owner of the socket file of a unix address
+  SocketMode  string `yaml:"socket-mode,omitempty"`   // e.g. "0660"
+  SocketOwner string `yaml:"socket-owner,omitempty"`  // "user" or "user:group"
+
+  trustedProxies *TrustedProxies  // parsed TrustedProxies. nil when not set
+  socketMode os.FileMode  // parsed SocketMode. 0 when not set
+  socketUid  int          // parsed SocketOwner. -1 when not set
+  socketGid  int
+}
+
+
+// network returns "unix" for unix socket addresses and "tcp" otherwise
+//
+func (c *ServerConfig) network() string {
+  if strings.HasPrefix(c.Address, "unix:") {
+    return "unix"
+  }
+  return "tcp"
 }
 
 func (c *ServerConfig) onLoad() error {
@@ -62,13 +167,248 @@ func (c *ServerConfig) onLoad() error {
     c.Type = "http"
   } else {
     c.Type = strings.ToLower(c.Type)
-    if c.Type != "http" && c.Type != "https" {
+    if c.Type != "http" && c.Type != "https" && c.Type != "h2c" {
       return errorf("invalid type %q in server config", c.Type)
     }
   }
+  if err := checkFilePatterns(c.Deny); err != nil {
+    return err
+  }
+  if err := checkFilePatterns(c.Allow); err != nil {
+    return err
+  }
+  for _, rl := range c.RateLimits {
+    if err := rl.onLoad(); err != nil {
+      return err
+    }
+  }
+  c.trustedProxies = nil
+  if len(c.TrustedProxies) > 0 {
+    var err error
+    if c.trustedProxies, err = ParseTrustedProxies(c.TrustedProxies); err != nil {
+      return err
+    }
+  }
+  if c.ProxyProtocol && c.network() == "unix" {
+    return errorf("proxy-protocol is not supported on unix socket %q", c.Address)
+  }
+  if c.MaxConnections < 0 || c.MaxRequests < 0 || c.MaxBodySize < 0 {
+    return errorf("negative limit in server config for %q", c.Address)
+  }
+  c.socketUid = -1
+  c.socketGid = -1
+  if c.network() == "unix" {
+    if c.Address == "unix:" {
+      return errorf("missing socket path in server address %q", c.Address)
+    }
+    if err := c.parseSocketPerms(); err != nil {
+      return err
+    }
+  } else if c.SocketMode != "" || c.SocketOwner != "" {
+    logf("warning: server config with unused socket-mode or socket-owner (not unix)")
+  }
+  for _, rc := range c.Routes {
+    if err := rc.onLoad(); err != nil {
+      return err
+    }
+  }
   return nil
 }
 
+
+func (c *ServerConfig) parseSocketPerms() error {
+  if c.SocketMode != "" {
+    mode, err := strconv.ParseUint(c.SocketMode, 8, 32)
+    if err != nil || mode > 0777 {
+      return errorf("invalid socket-mode %q in server config", c.SocketMode)
+    }
+    c.socketMode = os.FileMode(mode)
+  }
+  if c.SocketOwner != "" {
+    name, group := c.SocketOwner, ""
+    if i := strings.IndexByte(name, ':'); i != -1 {
+      name, group = name[:i], name[i+1:]
+    }
+    if name != "" {
+      u, err := user.Lookup(name)
+      if err != nil {
+        if u, err = user.LookupId(name); err != nil {
+          return errorf("invalid socket-owner %q in server config: %v", c.SocketOwner, err)
+        }
+      }
+      c.socketUid, _ = strconv.Atoi(u.Uid)
+      if group == "" {
+        c.socketGid, _ = strconv.Atoi(u.Gid)
+      }
+    }
+    if group != "" {
+      g, err := user.LookupGroup(group)
+      if err != nil {
+        if g, err = user.LookupGroupId(group); err != nil {
+          return errorf("invalid socket-owner %q in server config: %v", c.SocketOwner, err)
+        }
+      }
+      c.socketGid, _ = strconv.Atoi(g.Gid)
+    }
+  }
+  return nil
+}
+
+
+type RouteConfig struct {
+  Match    string  // URL path pattern. See RoutePattern
+  Rewrite  string `yaml:",omitempty"`  // internal rewrite target
+  Redirect string `yaml:",omitempty"`  // external redirect target
+  Status   int    `yaml:",omitempty"`  // redirect status code (default 302)
+
+  // upstream to forward requests to, e.g. "http://127.0.0.1:3000/api" or
+  // "unix:/run/app.sock"
+  Proxy       string `yaml:",omitempty"`
+  HealthCheck *HealthCheckConfig `yaml:"health-check,omitempty"`
+
+  // exempt matching requests from the server's read and write timeouts
+  NoTimeout bool `yaml:"no-timeout,omitempty"`
+
+  pattern *RoutePattern
+}
+
+func (c *RouteConfig) onLoad() error {
+  if c.Match == "" {
+    return errorf("missing match in route config")
+  }
+  ntargets := 0
+  for _, target := range []string{c.Rewrite, c.Redirect, c.Proxy} {
+    if target != "" {
+      ntargets++
+    }
+  }
+  if ntargets > 1 {
+    return errorf("route %q has more than one of rewrite, redirect and proxy",
+      c.Match)
+  }
+  if c.Proxy != "" {
+    if _, _, err := parseProxyTarget(c.Proxy); err != nil {
+      return errorf("invalid proxy target %q of route %q: %v",
+        c.Proxy, c.Match, err)
+    }
+  }
+  if c.HealthCheck != nil {
+    if c.Proxy == "" {
+      return errorf("route %q has health-check but no proxy", c.Match)
+    }
+    if err := c.HealthCheck.onLoad(); err != nil {
+      return err
+    }
+  }
+  if c.Rewrite != "" && c.Rewrite[0] != '/' {
+    return errorf("rewrite target %q of route %q must start with \"/\"",
+      c.Rewrite, c.Match)
+  }
+  if c.Status != 0 && (c.Status < 300 || c.Status > 399) {
+    return errorf("invalid redirect status %d in route %q", c.Status, c.Match)
+  }
+  var err error
+  c.pattern, err = ParseRoutePattern(c.Match)
+  return err
+}
+
+// RateLimitConfig limits the request rate of each client for paths
+// matching a route pattern. See RateLimiter.
+//
+type RateLimitConfig struct {
+  Match      string   // URL path pattern. See RoutePattern
+  Rate       float64  // requests per second, on average
+  Burst      int      // max requests at once. Defaults to max(1, rate)
+  Key        string   // "ip" (default) or "header:Name" set by trusted proxies
+  MaxClients int      `yaml:"max-clients"`  // clients tracked. Defaults to 10000
+
+  pattern *RoutePattern
+  header  string  // parsed Key
+}
+
+func (c *RateLimitConfig) onLoad() error {
+  if c.Match == "" {
+    return errorf("missing match in rate-limit config")
+  }
+  if c.Rate <= 0 {
+    return errorf("rate-limit %q must have a rate > 0", c.Match)
+  }
+  if c.Burst <= 0 {
+    c.Burst = int(c.Rate)
+    if c.Burst < 1 {
+      c.Burst = 1
+    }
+  }
+  if c.MaxClients <= 0 {
+    c.MaxClients = 10000
+  }
+  var err error
+  if c.header, err = parseRateLimitKey(c.Key); err != nil {
+    return errorf("rate-limit %q: %v", c.Match, err)
+  }
+  c.pattern, err = ParseRoutePattern(c.Match)
+  return err
+}
+
+type HealthCheckConfig struct {
+  Path     string         // URL path requested on the upstream, e.g. "/health"
+  Interval time.Duration  // time between checks. Defaults to 10s
+  Timeout  time.Duration  // max time for a check. Defaults to 2s
+}
+
+func (c *HealthCheckConfig) onLoad() error {
+  if c.Path == "" || c.Path[0] != '/' {
+    return errorf("health-check path %q must start with \"/\"", c.Path)
+  }
+  if c.Interval <= 0 {
+    c.Interval = 10 * time.Second
+  }
+  if c.Timeout <= 0 {
+    c.Timeout = 2 * time.Second
+  }
+  return nil
+}
+
+// AuthConfig protects URL paths with HTTP Basic authentication, checked
+// against the users of an htpasswd file.
+//
+type AuthConfig struct {
+  Match    string  // URL path pattern. See RoutePattern
+  Realm    string  // shown by browsers when asking for credentials
+  Htpasswd string  // file with "user:hash" lines. bcrypt or {SHA} hashes
+
+  pattern  *RoutePattern
+  htpasswd *Htpasswd
+}
+
+func (c *AuthConfig) onLoad() error {
+  if c.Match == "" {
+    return errorf("missing match in auth config")
+  }
+  if c.Htpasswd == "" {
+    return errorf("missing htpasswd in auth config for %q", c.Match)
+  }
+  if c.Realm == "" {
+    c.Realm = "Restricted"
+  } else if strings.ContainsAny(c.Realm, "\"\r\n") {
+    return errorf("invalid realm %q in auth config for %q", c.Realm, c.Match)
+  }
+  var err error
+  c.pattern, err = ParseRoutePattern(c.Match)
+  return err
+}
+
+// initAuthConfigs resolves the htpasswd files of auth rules, relative to
+// the current directory
+//
+func initAuthConfigs(rules []*AuthConfig) {
+  for _, ac := range rules {
+    ac.Htpasswd = abspath(ac.Htpasswd)
+    ac.htpasswd = NewHtpasswd(ac.Htpasswd)
+  }
+}
+
+
 type AutocertConfig struct {
   // Hostnames to whitelist. (required)
   // Must be fully qualified domain names (wildcards not supported.)
@@ -81,12 +421,237 @@ type AutocertConfig struct {
 }
 
 
+// SiteConfig describes a virtual host; a pub-dir served for requests with
+// a Host header matching any of Hosts.
+// DirList, Pages and Servlet override the server and top-level config
+// when set.
+//
+type SiteConfig struct {
+  Hosts   []string  // e.g. "example.com", "*.example.com" or "*"
+  PubDir  string          `yaml:"pub-dir"`
+  DirList *DirListConfig  `yaml:",omitempty"`
+  Pages   *PagesConfig    `yaml:",omitempty"`
+  Servlet *ServletConfig  `yaml:",omitempty"`
+  Index   []string        `yaml:",omitempty"`
+  CleanUrls *CleanUrlsConfig `yaml:"clean-urls,omitempty"`
+  Auth    []*AuthConfig   `yaml:",omitempty"`
+}
+
+func (c *SiteConfig) onLoad() error {
+  if len(c.Hosts) == 0 {
+    return errorf("missing hosts in site config")
+  }
+  if c.PubDir == "" {
+    return errorf("missing pub-dir in site config for %q", c.Hosts[0])
+  }
+  for i, host := range c.Hosts {
+    c.Hosts[i] = strings.ToLower(host)
+  }
+  if err := checkIndexNames(c.Index); err != nil {
+    return err
+  }
+  for _, ac := range c.Auth {
+    if err := ac.onLoad(); err != nil {
+      return err
+    }
+  }
+  if c.CleanUrls != nil {
+    return c.CleanUrls.onLoad()
+  }
+  return nil
+}
+
+
+// checkIndexNames returns an error if any of names is not a file name
+//
+func checkIndexNames(names []string) error {
+  for _, name := range names {
+    if name == "" || strings.ContainsAny(name, "/\\") {
+      return errorf("invalid index name %q", name)
+    }
+  }
+  return nil
+}
+
+
+// CleanUrlsConfig enables URLs without file extensions, e.g. "/about" for
+// "about.ghp". See HttpServer.resolve.
+//
+type CleanUrlsConfig struct {
+  Enabled    bool
+  Extensions []string `yaml:",omitempty"`  // tried in order. Default: page file-ext, ".html"
+  Redirect   bool  // redirect URLs with an extension to the clean URL
+}
+
+func (c *CleanUrlsConfig) onLoad() error {
+  for i, ext := range c.Extensions {
+    ext = "." + strings.TrimLeft(ext, ".")
+    if ext == "." || strings.ContainsAny(ext, "/\\") {
+      return errorf("invalid clean-urls extension %q", c.Extensions[i])
+    }
+    c.Extensions[i] = ext
+  }
+  return nil
+}
+
+
 type DirListConfig struct {
   Enabled  bool
   Template string
 }
 
 
+type AccessLogConfig struct {
+  Enabled bool
+  Format  string  // "common", "combined" or "json"
+  File    string  // empty or "-" for stdout
+}
+
+func (c *AccessLogConfig) onLoad() error {
+  switch c.Format {
+  case "":
+    c.Format = "common"
+  case "common", "combined", "json":
+  default:
+    return errorf("invalid access-log.format %q", c.Format)
+  }
+  return nil
+}
+
+
+// MetricsConfig exposes metrics in the Prometheus text format at Path,
+// either on all servers or on a separate server listening on Address.
+//
+type MetricsConfig struct {
+  Enabled bool
+  Path    string  // URL path. Defaults to "/metrics"
+  Address string  // "host:port" or "unix:/path". "" to use all servers
+
+  server *ServerConfig  // config of metrics server when Address is set
+}
+
+func (c *MetricsConfig) onLoad() error {
+  if c.Path == "" {
+    c.Path = "/metrics"
+  } else if c.Path[0] != '/' {
+    return errorf("metrics.path %q must start with \"/\"", c.Path)
+  }
+  c.server = nil
+  if c.Address != "" {
+    c.server = &ServerConfig{ Address: c.Address }
+    if err := c.server.onLoad(); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+
+// HealthConfig sets the URL paths of liveness and readiness probes, which
+// are answered by all servers. "" disables a probe.
+//
+type HealthConfig struct {
+  Liveness  string  // e.g. "/healthz"
+  Readiness string  // e.g. "/readyz"
+}
+
+func (c *HealthConfig) onLoad() error {
+  for _, path := range []string{c.Liveness, c.Readiness} {
+    if path != "" && path[0] != '/' {
+      return errorf("health path %q must start with \"/\"", path)
+    }
+  }
+  return nil
+}
+
+
+// ShutdownConfig bounds graceful shutdown. See Ghp.Shutdown.
+//
+type ShutdownConfig struct {
+  // max time for requests in flight to complete, after which remaining
+  // connections are closed. Defaults to 30s
+  Timeout time.Duration
+
+  // max time for each call to a servlet's StopServlet. Defaults to 10s
+  StopServletTimeout time.Duration `yaml:"stop-servlet-timeout"`
+}
+
+func (c *ShutdownConfig) onLoad() error {
+  if c.Timeout < 0 || c.StopServletTimeout < 0 {
+    return errorf("negative shutdown timeout")
+  }
+  if c.Timeout == 0 {
+    c.Timeout = 30 * time.Second
+  }
+  if c.StopServletTimeout == 0 {
+    c.StopServletTimeout = 10 * time.Second
+  }
+  return nil
+}
+
+
+// AdminConfig enables the admin server. See Admin.
+//
+type AdminConfig struct {
+  Enabled bool
+  Address string  // loopback "host:port" or "unix:/path"
+
+  server *ServerConfig
+}
+
+func (c *AdminConfig) onLoad() error {
+  c.server = nil
+  if !c.Enabled {
+    return nil
+  }
+  if c.Address == "" {
+    return errorf("missing admin.address")
+  }
+  c.server = &ServerConfig{ Address: c.Address }
+  if err := c.server.onLoad(); err != nil {
+    return err
+  }
+  if c.server.network() == "tcp" {
+    // the admin server has no authentication
+    host, _, err := net.SplitHostPort(c.Address)
+    if err != nil {
+      return errorf("invalid admin.address %q: %v", c.Address, err)
+    }
+    if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+      return errorf("admin.address %q must be a loopback address or unix socket",
+        c.Address)
+    }
+  }
+  return nil
+}
+
+
+type CompressionConfig struct {
+  Enabled       bool
+  Encodings     []string  // in order of preference, e.g. [br, gzip]
+  MinSize       int      `yaml:"min-size"`  // bytes
+  Types         []string  // MIME types to compress, e.g. "text/*"
+  Precompressed bool      // serve e.g. foo.css.gz in place of foo.css
+}
+
+func (c *CompressionConfig) onLoad() error {
+  for i, enc := range c.Encodings {
+    enc = strings.ToLower(enc)
+    if _, ok := precompressedExt[enc]; !ok {
+      return errorf("unsupported encoding %q in compression.encodings", enc)
+    }
+    c.Encodings[i] = enc
+  }
+  for i, t := range c.Types {
+    c.Types[i] = strings.ToLower(t)
+  }
+  if c.MinSize < 0 {
+    return errorf("invalid compression.min-size %d", c.MinSize)
+  }
+  return nil
+}
+
+
 type ZdrConfig struct {
   Enabled bool
   Group   string
@@ -115,6 +680,16 @@ type ServletConfig struct {
 type PagesConfig struct {
   Enabled bool
   FileExt string `yaml:"file-ext"`
+  Markdown MarkdownConfig
+}
+
+
+// MarkdownConfig configures rendering of Markdown files as pages
+//
+type MarkdownConfig struct {
+  Enabled bool
+  FileExt string `yaml:"file-ext"`  // default "md"
+  Layout  string  // file name of conventional layout pages. Default "_layout" + page file-ext
 }
 
 
@@ -122,6 +697,30 @@ type GoConfig struct {
   Gopath string  // in addition to ghpdir/gopath
 }
 
+// durationOr returns *d, or def if d is nil
+//
+func durationOr(d *time.Duration, def time.Duration) time.Duration {
+  if d != nil {
+    return *d
+  }
+  return def
+}
+
+
+// servletsEnabled returns true if servlets are enabled for any site
+//
+func (c *GhpConfig) servletsEnabled() bool {
+  if c.Servlet.Enabled {
+    return true
+  }
+  for _, sc := range c.Sites {
+    if sc.Servlet != nil && sc.Servlet.Enabled {
+      return true
+    }
+  }
+  return false
+}
+
 // ---------------------------------------------------------------------
 
 func (c *GhpConfig) load(r io.Reader) error {
@@ -233,6 +832,24 @@ func loadConfig(explicitFile string) (*GhpConfig, string, error) {
   // Canonicalize paths (preserves symlinks)
   c.PubDir = abspath(c.PubDir)
   c.CacheDir = abspath(c.CacheDir)
+  if c.AccessLog.File != "" && c.AccessLog.File != "-" {
+    c.AccessLog.File = abspath(c.AccessLog.File)
+  }
+  for _, sc := range c.Sites {
+    sc.PubDir = abspath(sc.PubDir)
+    initAuthConfigs(sc.Auth)
+  }
+  for _, sc := range []*ServerConfig{ c.Metrics.server, c.Admin.server } {
+    if sc != nil && sc.network() == "unix" {
+      sc.Address = "unix:" + abspath(sc.Address[len("unix:"):])
+    }
+  }
+  initAuthConfigs(c.Auth)
+  for _, sc := range c.Servers {
+    if sc.network() == "unix" {
+      sc.Address = "unix:" + abspath(sc.Address[len("unix:"):])
+    }
+  }
   c.Go.Gopath = abspathList(c.Go.Gopath)
 
   return c, filename, nil
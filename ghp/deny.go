@@ -0,0 +1,121 @@
+package main
+
+import (
+  "path"
+  "strings"
+)
+
+
+// FileFilter decides which files in a pub-dir are private and must not be
+// served or listed.
+//
+// A pattern without a "/" is matched against the name of each path
+// component, so "*.go" matches "/foo/bar.go" and ".*" matches "/.git/config".
+// A pattern with a "/" is matched against the full URL path and its parent
+// directories, so "/private/*" matches "/private/a/b".
+// A path is denied if any component matches a deny pattern and that
+// component doesn't also match an allow pattern.
+//
+// A filter applies to paths below its base directory, e.g. "/foo", and
+// patterns with a "/" are relative to base.
+//
+type FileFilter struct {
+  base  string  // URL path of directory the filter applies to, e.g. "/"
+  deny  []string
+  allow []string
+}
+
+
+// defaultDeny lists files which are private in every pub-dir. Configured
+// deny patterns are added to these.
+//
+var defaultDeny = []string{ "*.go", "go.mod", "go.sum", ".*", "ghp.yaml" }
+
+// defaultAllow lists exceptions to defaultDeny
+//
+var defaultAllow = []string{ ".well-known" }
+
+
+func NewFileFilter(base string, deny, allow []string) *FileFilter {
+  return &FileFilter{ base: path.Clean("/" + base), deny: deny, allow: allow }
+}
+
+
+// checkFilePatterns returns an error if any of patterns is malformed
+//
+func checkFilePatterns(patterns []string) error {
+  for _, pattern := range patterns {
+    if _, err := path.Match(pattern, ""); err != nil {
+      return errorf("invalid file pattern %q: %v", pattern, err)
+    }
+  }
+  return nil
+}
+
+
+// Denied returns true if urlpath, e.g. "/foo/bar.go", is private
+//
+func (f *FileFilter) Denied(urlpath string) bool {
+  return fileDenied(urlpath, f)
+}
+
+
+// fileDenied returns true if urlpath is denied by any of filters.
+// Patterns allowed by any of filters override patterns denied by others,
+// e.g. a subdirectory can allow a file denied by a parent directory.
+//
+func fileDenied(urlpath string, filters ...*FileFilter) bool {
+  urlpath = path.Clean("/" + urlpath)
+  for end := 1; end <= len(urlpath); end++ {
+    if end < len(urlpath) && urlpath[end] != '/' {
+      continue
+    }
+    start := strings.LastIndexByte(urlpath[:end], '/') + 1
+    if start == end {
+      continue  // root
+    }
+    dirpath, name := urlpath[:end], urlpath[start:end]
+    denied := anyFilterMatch(filters, true, dirpath, name)
+    if denied && !anyFilterMatch(filters, false, dirpath, name) {
+      return true
+    }
+  }
+  return false
+}
+
+
+// anyFilterMatch returns true if the deny (or allow when deny is false)
+// patterns of any of filters matches a path component.
+// fullpath is the path up to and including the component named name.
+//
+func anyFilterMatch(filters []*FileFilter, deny bool, fullpath, name string) bool {
+  for _, f := range filters {
+    if f == nil {
+      continue
+    }
+    patterns := f.allow
+    if deny {
+      patterns = f.deny
+    }
+    if len(patterns) == 0 {
+      continue
+    }
+    relpath := fullpath
+    if f.base != "/" {
+      if !strings.HasPrefix(fullpath, f.base + "/") {
+        continue  // outside of filter's directory
+      }
+      relpath = fullpath[len(f.base):]
+    }
+    for _, pattern := range patterns {
+      subject := name
+      if strings.IndexByte(pattern, '/') != -1 {
+        subject = relpath
+      }
+      if ok, _ := path.Match(pattern, subject); ok {
+        return true
+      }
+    }
+  }
+  return false
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+  "net/http"
+  "testing"
+)
+
+
+func TestFileDenied(t *testing.T) {
+  root := NewFileFilter("/", concatStrings(defaultDeny, []string{ "/private/*", "*.txt" }),
+    concatStrings(defaultAllow, []string{ "/private/pub" }))
+  sub := NewFileFilter("/docs", []string{ "/drafts" }, []string{ "notes.txt" })
+
+  for _, tc := range []struct {
+    urlpath string
+    denied  bool
+  }{
+    { "/", false },
+    { "/index.html", false },
+    { "/main.go", true },
+    { "/foo/bar.go", true },
+    { "/foo/bar.gob", false },
+    { "/go.mod", true },
+    { "/sub/go.sum", true },
+    { "/ghp.yaml", true },
+    { "/foo/.ghp.yaml", true },
+    { "/.git/config", true },
+    { "/foo/.env", true },
+    { "/.well-known/acme-challenge/x", false },
+    { "/.well-known/.secret", true },  // allow applies to one component
+    { "/private", false },
+    { "/private/a", true },
+    { "/private/a/b.html", true },
+    { "/private/pub", false },
+    { "/private/pub/a.html", false },
+    { "/foo/private/a", false },  // "/" patterns are relative to base
+    { "/a.txt", true },
+    { "/docs/a.html", false },
+    { "/docs/drafts", true },
+    { "/docs/drafts/a.html", true },
+    { "/drafts/a.html", false },
+    { "/docs/notes.txt", false },  // sub allows what root denies
+    { "/notes.txt", true },
+    { "/foo/../main.go", true },
+  } {
+    if denied := fileDenied(tc.urlpath, root, sub); denied != tc.denied {
+      t.Errorf("%s: denied=%v, expected %v", tc.urlpath, denied, tc.denied)
+    }
+  }
+}
+
+
+func TestCheckFilePatterns(t *testing.T) {
+  if err := checkFilePatterns([]string{ "*.go", "/a/[bc]" }); err != nil {
+    t.Errorf("unexpected error: %v", err)
+  }
+  if err := checkFilePatterns([]string{ "a[" }); err == nil {
+    t.Errorf("expected error for malformed pattern")
+  }
+}
+
+
+// TestDenyDefaults verifies that private files are denied when the
+// configuration has a deny list of its own
+//
+func TestDenyDefaults(t *testing.T) {
+  s, cleanup := newTestServer(t, map[string]string{
+    "index.html": "home",
+    "secret/a.html": "secret",
+    "servlet/servlet.go": "package main",
+    "servlet/go.mod": "module servlet",
+    ".env": "KEY=x",
+    ".well-known/security.txt": "Contact: x",
+  }, `
+deny: [secret]
+`)
+  defer cleanup()
+
+  for _, tc := range []struct {
+    urlpath string
+    status  int
+  }{
+    { "/index.html", http.StatusOK },
+    { "/secret/a.html", http.StatusNotFound },
+    { "/servlet/servlet.go", http.StatusNotFound },
+    { "/servlet/go.mod", http.StatusNotFound },
+    { "/.env", http.StatusNotFound },
+    { "/.well-known/security.txt", http.StatusOK },
+  } {
+    expectStatus(t, testGet(s, tc.urlpath, ""), tc.urlpath, tc.status)
+  }
+}
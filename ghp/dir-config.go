@@ -0,0 +1,269 @@
+package main
+
+import (
+  "bytes"
+  "io"
+  "io/ioutil"
+  "net/http"
+  "os"
+  "path/filepath"
+  "strings"
+  "sync"
+
+  "gopkg.in/yaml.v2"
+)
+
+const dirConfigFilename = ".ghp.yaml"
+
+
+// DirConfig is the configuration of a pub-dir subtree, read from a
+// ".ghp.yaml" file in the subtree's directory.
+// Properties not set are inherited from the parent directory.
+//
+type DirConfig struct {
+  DirList *DirListConfig    `yaml:",omitempty"`
+  Index   []string          `yaml:",omitempty"`  // index file names, in order of preference
+  Headers map[string]string `yaml:",omitempty"`  // response headers. "" unsets
+  Pages   struct {
+    FileExt string `yaml:"file-ext,omitempty"`
+  } `yaml:",omitempty"`
+  Deny    []string `yaml:",omitempty"`  // added to inherited deny patterns
+  Allow   []string `yaml:",omitempty"`  // added to inherited allow patterns
+  Fallback string  `yaml:",omitempty"`  // served for missing paths, e.g. "index.html"
+}
+
+func (c *DirConfig) onLoad() error {
+  if err := checkIndexNames(c.Index); err != nil {
+    return err
+  }
+  if err := checkFilePatterns(c.Deny); err != nil {
+    return err
+  }
+  return checkFilePatterns(c.Allow)
+}
+
+
+// dirConfig is the effective configuration of a directory, which is its
+// DirConfig merged with that of its parent directories.
+//
+type dirConfig struct {
+  dir     string      // filesystem path
+  parent  *dirConfig  // nearest parent with a config file. nil for root
+  mtime   int64       // mtime of config file
+  err     error       // error from loading config file
+
+  dirlistSet bool            // true if dirlist is set for the subtree
+  dirlist    *HtmlDirLister  // nil if disabled
+  index      []string        // nil for default
+  headers    map[string]string
+  pageExt    string          // "" for default
+  filters    []*FileFilter
+  fallback   string          // filesystem path. See HttpServer.resolveFallback
+}
+
+
+// Denied returns true if urlpath is denied by the directory's rules or
+// by any of base
+//
+func (dc *dirConfig) Denied(urlpath string, base ...*FileFilter) bool {
+  if dc == nil || len(dc.filters) == 0 {
+    return fileDenied(urlpath, base...)
+  }
+  filters := make([]*FileFilter, 0, len(dc.filters) + len(base))
+  filters = append(filters, base...)
+  filters = append(filters, dc.filters...)
+  return fileDenied(urlpath, filters...)
+}
+
+
+// applyHeaders sets the directory's response headers on h
+//
+func (dc *dirConfig) applyHeaders(h http.Header) {
+  if dc == nil {
+    return
+  }
+  for k, v := range dc.headers {
+    h[k] = []string{v}
+  }
+}
+
+// ---------------------------------------------------------------------------
+
+// DirConfigCache loads and caches ".ghp.yaml" files of a site.
+// Files are reloaded when their modification time changes.
+//
+type DirConfigCache struct {
+  site    *Site
+  items   map[string]*dirConfig  // keyed by directory
+  itemsmu sync.RWMutex
+}
+
+
+func NewDirConfigCache(site *Site) *DirConfigCache {
+  return &DirConfigCache{
+    site: site,
+    items: make(map[string]*dirConfig),
+  }
+}
+
+
+// Get returns the effective configuration of directory dir.
+// Returns nil if neither dir nor any of its parents has a config file.
+//
+func (c *DirConfigCache) Get(dir string) (*dirConfig, error) {
+  pubdir := c.site.pubdir
+  rel, err := filepath.Rel(pubdir, dir)
+  if err != nil || rel == ".." || strings.HasPrefix(rel, ".." + string(filepath.Separator)) {
+    rel = "."
+  }
+
+  var dc *dirConfig
+  dir = pubdir
+  for {
+    if dc, err = c.getDir(dir, dc); err != nil {
+      return nil, err
+    }
+    if rel == "." {
+      return dc, nil
+    }
+    i := strings.IndexByte(rel, filepath.Separator)
+    if i == -1 {
+      dir = filepath.Join(dir, rel)
+      rel = "."
+    } else {
+      dir = filepath.Join(dir, rel[:i])
+      rel = rel[i+1:]
+    }
+  }
+}
+
+
+// getDir returns the configuration of dir, given the configuration of its
+// parent. Returns parent if dir does not have a config file.
+//
+func (c *DirConfigCache) getDir(dir string, parent *dirConfig) (*dirConfig, error) {
+  d, err := os.Stat(filepath.Join(dir, dirConfigFilename))
+  if err != nil {
+    return parent, nil
+  }
+  mtime := d.ModTime().UnixNano()
+
+  c.itemsmu.RLock()
+  dc := c.items[dir]
+  c.itemsmu.RUnlock()
+
+  if dc == nil || dc.mtime != mtime || dc.parent != parent {
+    dc = c.load(dir, parent, mtime)
+    c.itemsmu.Lock()
+    c.items[dir] = dc
+    c.itemsmu.Unlock()
+  }
+
+  return dc, dc.err
+}
+
+
+func (c *DirConfigCache) load(dir string, parent *dirConfig, mtime int64) *dirConfig {
+  filename := filepath.Join(dir, dirConfigFilename)
+  if devMode {
+    logf("[dirconfig] loading %s", relfile(c.site.pubdir, filename))
+  }
+
+  dc := &dirConfig{
+    dir: dir,
+    parent: parent,
+    mtime: mtime,
+  }
+
+  // inherit from parent
+  if parent != nil {
+    dc.dirlistSet = parent.dirlistSet
+    dc.dirlist = parent.dirlist
+    dc.index = parent.index
+    dc.pageExt = parent.pageExt
+    dc.filters = parent.filters
+    dc.headers = parent.headers
+    dc.fallback = parent.fallback
+  }
+
+  var conf DirConfig
+  data, err := ioutil.ReadFile(filename)
+  if err == nil {
+    d := yaml.NewDecoder(bytes.NewReader(data))
+    d.SetStrict(true)
+    if err = d.Decode(&conf); err == io.EOF {
+      err = nil  // empty file
+    }
+  }
+  if err == nil {
+    err = conf.onLoad()
+  }
+  if err != nil {
+    dc.err = errorf("%s: %v", relfile(c.site.pubdir, filename), err)
+    return dc
+  }
+
+  if conf.DirList != nil {
+    dc.dirlistSet = true
+    dc.dirlist = nil
+    if conf.DirList.Enabled {
+      dlc := *conf.DirList
+      if dlc.Template != "" && !filepath.IsAbs(dlc.Template) {
+        dlc.Template = filepath.Join(dir, dlc.Template)
+      }
+      if dc.dirlist, err = NewHtmlDirLister(c.site.pubdir, &dlc); err != nil {
+        dc.err = err
+        return dc
+      }
+    }
+  }
+
+  if len(conf.Index) > 0 {
+    dc.index = conf.Index
+  }
+
+  if conf.Pages.FileExt != "" {
+    dc.pageExt = "." + strings.TrimLeft(conf.Pages.FileExt, ".")
+  }
+
+  if len(conf.Deny) > 0 || len(conf.Allow) > 0 {
+    base := "/" + filepath.ToSlash(relfile(c.site.pubdir, dir))
+    filters := make([]*FileFilter, len(dc.filters), len(dc.filters) + 1)
+    copy(filters, dc.filters)
+    dc.filters = append(filters, NewFileFilter(base, conf.Deny, conf.Allow))
+  }
+
+  if conf.Fallback != "" {
+    // relative to dir, or to pub-dir when starting with "/"
+    base := dir
+    if strings.HasPrefix(conf.Fallback, "/") {
+      base = c.site.pubdir
+    }
+    fallback := filepath.Join(base, filepath.FromSlash(conf.Fallback))
+    rel, err := filepath.Rel(c.site.pubdir, fallback)
+    if err != nil || rel == ".." || strings.HasPrefix(rel, ".." + string(filepath.Separator)) {
+      dc.err = errorf("%s: fallback %q is outside of pub-dir",
+        relfile(c.site.pubdir, filename), conf.Fallback)
+      return dc
+    }
+    dc.fallback = fallback
+  }
+
+  if len(conf.Headers) > 0 {
+    headers := make(map[string]string, len(dc.headers) + len(conf.Headers))
+    for k, v := range dc.headers {
+      headers[k] = v
+    }
+    for k, v := range conf.Headers {
+      k = http.CanonicalHeaderKey(k)
+      if v == "" {
+        delete(headers, k)
+      } else {
+        headers[k] = v
+      }
+    }
+    dc.headers = headers
+  }
+
+  return dc
+}
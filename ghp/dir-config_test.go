@@ -0,0 +1,148 @@
+package main
+
+import (
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+)
+
+
+// writeTestFiles writes files, keyed by slash-separated path, to dir
+//
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+  for name, data := range files {
+    filename := filepath.Join(dir, filepath.FromSlash(name))
+    if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+      t.Fatal(err)
+    }
+    if err := ioutil.WriteFile(filename, []byte(data), 0600); err != nil {
+      t.Fatal(err)
+    }
+  }
+}
+
+
+func TestDirConfigInheritance(t *testing.T) {
+  pubdir, err := ioutil.TempDir("", "ghp-test")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(pubdir)
+  writeTestFiles(t, pubdir, map[string]string{
+    ".ghp.yaml": `
+index: [home.html]
+headers: { X-A: root, X-B: root }
+deny: ["*.txt"]
+pages: { file-ext: tpl }
+`,
+    "a/.ghp.yaml": `
+headers: { x-b: "", X-C: a }
+allow: [notes.txt]
+fallback: index.html
+`,
+    "a/b/.ghp.yaml": `
+index: [main.html]
+fallback: /spa.html
+`,
+    "a/b/c/x.html": "",
+    "a/empty/.ghp.yaml": "",
+    "bad/.ghp.yaml": "unknown: 1\n",
+    "out/.ghp.yaml": "fallback: ../../x\n",
+  })
+  c := NewDirConfigCache(NewSite(nil, &SiteConfig{ PubDir: pubdir }))
+  get := func(dir string) *dirConfig {
+    t.Helper()
+    dc, err := c.Get(filepath.Join(pubdir, filepath.FromSlash(dir)))
+    if err != nil {
+      t.Fatalf("%s: %v", dir, err)
+    }
+    return dc
+  }
+
+  for _, tc := range []struct {
+    dir      string
+    index    string
+    headers  string
+    pageExt  string
+    fallback string  // relative to pub-dir
+  }{
+    { ".", "home.html", "X-A=root X-B=root", ".tpl", "" },
+    { "x", "home.html", "X-A=root X-B=root", ".tpl", "" },
+    { "a", "home.html", "X-A=root X-C=a", ".tpl", "a/index.html" },
+    { "a/empty", "home.html", "X-A=root X-C=a", ".tpl", "a/index.html" },
+    { "a/b", "main.html", "X-A=root X-C=a", ".tpl", "spa.html" },
+    { "a/b/c", "main.html", "X-A=root X-C=a", ".tpl", "spa.html" },
+  } {
+    dc := get(tc.dir)
+    if s := strings.Join(dc.index, " "); s != tc.index {
+      t.Errorf("%s: index %q, expected %q", tc.dir, s, tc.index)
+    }
+    if s := formatParams(dc.headers); s != tc.headers {
+      t.Errorf("%s: headers %q, expected %q", tc.dir, s, tc.headers)
+    }
+    if dc.pageExt != tc.pageExt {
+      t.Errorf("%s: page ext %q, expected %q", tc.dir, dc.pageExt, tc.pageExt)
+    }
+    fallback := ""
+    if dc.fallback != "" {
+      fallback = filepath.ToSlash(relfile(pubdir, dc.fallback))
+    }
+    if fallback != tc.fallback {
+      t.Errorf("%s: fallback %q, expected %q", tc.dir, fallback, tc.fallback)
+    }
+  }
+
+  // deny and allow patterns add up, and "/" patterns are relative to the
+  // directory of the config file
+  dc := get("a/b/c")
+  for _, tc := range []struct {
+    urlpath string
+    denied  bool
+  }{
+    { "/x.txt", true },
+    { "/notes.txt", true },
+    { "/a/b/x.txt", true },
+    { "/a/b/notes.txt", false },
+    { "/a/b/c/x.html", false },
+  } {
+    if denied := dc.Denied(tc.urlpath); denied != tc.denied {
+      t.Errorf("%s: denied=%v, expected %v", tc.urlpath, denied, tc.denied)
+    }
+  }
+
+  // errors, which subdirectories inherit
+  for _, dir := range []string{ "bad", "bad/sub", "out" } {
+    if _, err := c.Get(filepath.Join(pubdir, dir)); err == nil {
+      t.Errorf("%s: expected error", dir)
+    }
+  }
+
+  // a changed file is reloaded, and so are its subdirectories
+  writeTestFiles(t, pubdir, map[string]string{ "a/.ghp.yaml": "headers: { X-C: a2 }\n" })
+  future := time.Now().Add(time.Minute)
+  os.Chtimes(filepath.Join(pubdir, "a", ".ghp.yaml"), future, future)
+  if s := formatParams(get("a/b/c").headers); s != "X-A=root X-B=root X-C=a2" {
+    t.Errorf("after change: headers %q", s)
+  }
+}
+
+
+func TestDirConfigNone(t *testing.T) {
+  pubdir, err := ioutil.TempDir("", "ghp-test")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(pubdir)
+  c := NewDirConfigCache(NewSite(nil, &SiteConfig{ PubDir: pubdir }))
+  dc, err := c.Get(filepath.Join(pubdir, "a", "b"))
+  if dc != nil || err != nil {
+    t.Errorf("expected nil config, got %v, %v", dc, err)
+  }
+  // methods are nil-safe
+  if dc.Denied("/a") {
+    t.Errorf("denied by nil config")
+  }
+}
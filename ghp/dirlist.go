@@ -87,8 +87,9 @@ func (a ByFilename) Less(i, j int) bool { return a[i].Name() < a[j].Name() }
 
 
 // RenderHtml generates a HTML directory listing.
+// Entries for which hidden returns true are not listed. hidden may be nil.
 //
-func (d *HtmlDirLister) RenderHtml(fspath string, userpath string) ([]byte, error) {
+func (d *HtmlDirLister) RenderHtml(fspath string, userpath string, hidden func(urlpath string) bool) ([]byte, error) {
   file, err := os.Open(fspath)
   if err != nil {
     return []byte{}, err
@@ -100,6 +101,16 @@ func (d *HtmlDirLister) RenderHtml(fspath string, userpath string) ([]byte, erro
     return []byte{}, err
   }
 
+  if hidden != nil {
+    visible := entries[:0]
+    for _, e := range entries {
+      if !hidden(pjoin(userpath, e.Name())) {
+        visible = append(visible, e)
+      }
+    }
+    entries = visible
+  }
+
   sort.Sort(ByFilename(entries))
 
   var w bytes.Buffer
@@ -0,0 +1,87 @@
+package main
+
+import (
+  "bytes"
+  "os"
+  "path"
+  "path/filepath"
+  "strconv"
+  "strings"
+)
+
+
+// findErrorPage returns the filename of the nearest "<status><fileext>"
+// page in the directory of urlpath or any of its parent directories.
+// Returns "" if there's no such page.
+//
+func (s *Site) findErrorPage(urlpath string, status int) string {
+  name := strconv.Itoa(status) + s.pageCache.fileext
+  dir := urlpath
+  if !strings.HasSuffix(dir, "/") {
+    dir = path.Dir(dir)
+  }
+  for {
+    filename := filepath.Join(s.pubdir, dir, name)
+    if checkIsFile(filename) == nil {
+      return filename
+    }
+    if dir == "/" || dir == "." {
+      return ""
+    }
+    dir = path.Dir(strings.TrimSuffix(dir, "/"))
+  }
+}
+
+
+// serveErrorPage responds with the nearest error page for status.
+// Returns false if there's no error page or if it failed to render, in
+// which case nothing has been written to w.
+//
+func (s *HttpServer) serveErrorPage(w *HttpResponse, status int, e *pageError) bool {
+  site := w.site
+  if site == nil || site.pageCache == nil || w.r == nil {
+    return false
+  }
+
+  filename := site.findErrorPage(w.r.URL.Path, status)
+  if filename == "" {
+    return false
+  }
+
+  f, err := os.Open(filename)
+  if err != nil {
+    return false
+  }
+  defer f.Close()
+
+  d, err := f.Stat()
+  if err != nil {
+    return false
+  }
+
+  p, err := site.pageCache.Get(&buildCtx{}, f, d)
+  if err != nil {
+    logf("error page %q failed to build: %v", relfile(site.pubdir, filename), err)
+    return false
+  }
+
+  data := p.newPageData(w.r)
+  data.Status = status
+  if devMode {
+    data.Error = e
+  }
+
+  // render to buffer so that we can fall back on a built-in page on error
+  var buf bytes.Buffer
+  if err := p.render(&buf, data); err != nil {
+    logf("error page %q failed to render: %v", p.name, err)
+    return false
+  }
+
+  w.setHandler("page", p.name)
+  p.setHeaders(w.Header())
+  w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+  w.WriteHeader(status)
+  w.Write(buf.Bytes())
+  return true
+}
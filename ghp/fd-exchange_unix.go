@@ -9,6 +9,10 @@ import (
 const fdExchangeMaxFDsPerMsg = 4
   // max number of fds to send in one message
 
+// fdExchangeData is sent along with each message of fds, since stream
+// sockets (e.g. on Linux) don't deliver control messages without data
+var fdExchangeData = []byte{0}
+
 
 // FdExchangeSendFiles sends files over conn.
 //
@@ -57,7 +61,7 @@ func FdExchangeSendFDs(conn net.Conn, fds... int) error {
   if nremain <= n {
     // common case
     oobbuf := syscall.UnixRights(fds...)
-    return syscall.Sendmsg(sockfd, nil, oobbuf, nil, 0)
+    return syscall.Sendmsg(sockfd, fdExchangeData, oobbuf, nil, 0)
   }
 
   // send in chunks to avoid unknown system limits
@@ -66,7 +70,7 @@ func FdExchangeSendFDs(conn net.Conn, fds... int) error {
       n = nremain
     }
     oobbuf := syscall.UnixRights(fds[:n]...)
-    if err := syscall.Sendmsg(sockfd, nil, oobbuf, nil, 0); err != nil {
+    if err := syscall.Sendmsg(sockfd, fdExchangeData, oobbuf, nil, 0); err != nil {
       return err
     }
     if n == nremain {
@@ -109,13 +113,14 @@ func fdExchangeRecvFDs(fds []int, sockfd, count int) ([]int, error) {
   oobbuf := make([]byte, syscall.CmsgSpace(count * 4))
 
   // read from socket into oobbuf
-  _, _, _, _, err := syscall.Recvmsg(sockfd, nil, oobbuf, 0)
+  buf := make([]byte, len(fdExchangeData))
+  _, oobn, _, _, err := syscall.Recvmsg(sockfd, buf, oobbuf, 0)
   if err != nil {
     return nil, errorf("syscall.Recvmsg: %v", err)
   }
 
   // parse messages in oobbuf
-  mv, err := syscall.ParseSocketControlMessage(oobbuf)
+  mv, err := syscall.ParseSocketControlMessage(oobbuf[:oobn])
   if err != nil {
     return nil, errorf("syscall.ParseSocketControlMessage %v", err)
   }
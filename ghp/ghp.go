@@ -1,6 +1,7 @@
 package main
 
 import (
+  "context"
   "crypto/sha1"
   "encoding/base64"
   "fmt"
@@ -11,6 +12,8 @@ import (
   "regexp"
   "runtime"
   "strings"
+  "sync"
+  "sync/atomic"
   "time"
   // "io/ioutil"
   // "flag"
@@ -24,10 +27,20 @@ type Ghp struct {
   appCacheDir  string   // app-specific data cache
   appBuildDir  string   // app-specific build products
   servers      serverSet
-  servletCache *ServletCache
-  pageCache    *PageCache
+  site         *Site    // default site (config.PubDir)
+  sites        []*Site  // virtual-host sites (config.Sites)
   zdr          *Zdr  // zero-downtime restart
-  helperfuns   HelpersMap
+  accessLog    *AccessLog  // nil when disabled
+  state        int32  // stateStarting, stateReady or stateDraining. Atomic
+
+  startmu      sync.Mutex  // protects state transitions while starting
+  acquiring    bool        // listeners are being acquired. See beginAcquire
+  startDone    chan struct{}  // closed when Main is done starting
+  startOnce    sync.Once
+
+  shutdownOnce sync.Once
+  shutdownDone chan struct{}  // closed when Shutdown has completed
+  shutdownErr  error
 }
 
 
@@ -35,17 +48,40 @@ func NewGhp(ghpdir string, config *GhpConfig) (*Ghp, error) {
   g := &Ghp{
     ghpdir: ghpdir,
     config: config,
+    startDone: make(chan struct{}),
+    shutdownDone: make(chan struct{}),
   }
 
   // initialize appCacheDir and appBuildDir which is unique per
   // go config and pubdir
   g.initAppCacheDir()
 
+  // default site shares appCacheDir and appBuildDir with g
+  g.site = NewSite(g, &SiteConfig{ PubDir: config.PubDir, Auth: config.Auth })
+  g.site.appCacheDir = g.appCacheDir
+  g.site.appBuildDir = g.appBuildDir
+
+  // virtual-host sites have their own cache and build directories
+  for _, sc := range config.Sites {
+    site := NewSite(g, sc)
+    site.appCacheDir = pjoin(g.config.CacheDir, pubdirId(site.pubdir))
+    site.appBuildDir = pjoin(site.appCacheDir, appBuildDirname())
+    g.sites = append(g.sites, site)
+  }
+
   return g, nil
 }
 
 
+// allSites returns the default site followed by any virtual-host sites
+//
+func (g *Ghp) allSites() []*Site {
+  return append([]*Site{g.site}, g.sites...)
+}
+
+
 func (g *Ghp) Main() error {
+  defer g.endStart()
   if devMode {
     logf("running in development mode\n----")
     println("Configuration:")
@@ -53,6 +89,11 @@ func (g *Ghp) Main() error {
     println("----")
     println("  appCacheDir:", g.appCacheDir)
     println("  appBuildDir:", g.appBuildDir)
+    for _, site := range g.sites {
+      println("  " + site.String() + ":")
+      println("    pubDir:     ", site.pubdir)
+      println("    appCacheDir:", site.appCacheDir)
+    }
     println("----")
   }
 
@@ -64,26 +105,54 @@ func (g *Ghp) Main() error {
     s := NewHttpServer(g, serverConfig)
     g.servers.AddHttpServer(s)
   }
+  if c := &g.config.Metrics; c.Enabled && c.server != nil {
+    s := NewHttpServer(g, c.server)
+    s.metricsOnly = true
+    g.servers.AddHttpServer(s)
+  }
+  if c := &g.config.Admin; c.server != nil {
+    s := NewHttpServer(g, c.server)
+    s.admin = NewAdmin(g)
+    g.servers.AddHttpServer(s)
+  }
   AtExit(func() { g.servers.Close() }) // Make sure servers close at exit
 
-  // init pages system
-  if g.config.Pages.Enabled {
-    g.helperfuns = g.buildHelpers(getBaseHelpers())
-    g.pageCache = NewPageCache(g, &g.config.Pages)
+  // open access log
+  if g.config.AccessLog.Enabled {
+    var err error
+    if g.accessLog, err = OpenAccessLog(&g.config.AccessLog); err != nil {
+      return err
+    }
+    defer g.accessLog.Close()
   }
 
-  // init servlet system
-  if g.config.Servlet.Enabled {
-    if err := g.initServlets(&g.config.Servlet); err != nil {
+  // init pages and servlet systems of all sites
+  for _, site := range g.allSites() {
+    if err := site.init(); err != nil {
       return err
     }
   }
 
+  // a shutdown until now cancels startup, leaving any running process
+  // with its listeners
+  if !g.beginAcquire() {
+    g.endStart()
+    return g.awaitShutdown()
+  }
+
   // existing listening sockets, passed on from past process (zdr)
   var listeners []*ConnSock
 
   // init zero-downtime restart system (blocks on coordination)
   if g.config.Zdr.Enabled {
+    // leave the running process in charge rather than taking over with
+    // broken servlets
+    for _, site := range g.allSites() {
+      if names := site.preloadFailures(); len(names) > 0 {
+        return errorf("[%s] %s failed to preload", site, names[0])
+      }
+    }
+
     var err error
     listeners, err = g.startZdr(&g.config.Zdr)
     if err != nil {
@@ -96,6 +165,8 @@ func (g *Ghp) Main() error {
   if err := g.servers.Listen(listeners); err != nil {
     return err
   }
+  g.setState(stateReady)
+  g.endStart()
 
   // Serve. Blocks until all are done.
   if err := g.servers.Serve(); err != nil {
@@ -110,7 +181,8 @@ func (g *Ghp) Main() error {
     g.zdr.Close()
   }
 
-  return nil
+  // Await any graceful shutdown, e.g. from a signal, to complete
+  return g.awaitShutdown()
 }
 
 
@@ -118,25 +190,66 @@ func (g *Ghp) Close() error {
   if err := g.servers.Close(); err != nil {
     return err
   }
-  if g.servletCache != nil {
-    g.servletCache.Close()
+  for _, site := range g.allSites() {
+    site.Close()
   }
   return nil
 }
 
 
-func (g *Ghp) Shutdown() {
+// Shutdown gracefully shuts down g: servers stop accepting connections,
+// requests in flight get up to shutdown.timeout to complete and then
+// servlets are stopped. Only the first call has any effect; other calls
+// wait for it to complete. Returns a *shutdownError if connections had to
+// be closed or servlets failed to stop in time.
+//
+func (g *Ghp) Shutdown() error {
+  g.shutdownOnce.Do(func() {
+    g.shutdownErr = g.shutdown()
+    close(g.shutdownDone)
+  })
+  return g.shutdownErr
+}
+
+
+func (g *Ghp) shutdown() error {
+  c := &g.config.Shutdown
   if devMode {
     logf("graceful shutdown initiated")
   }
 
-  if err := g.servers.Shutdown(); err != nil {
+  // A shutdown while starting cancels startup, unless listeners are being
+  // acquired. They may have been handed over by zdr from a process which
+  // no longer serves them, so startup completes and they are drained
+  // rather than closed with connections waiting.
+  g.cancelStart()
+  <-g.startDone
+
+  // fail readiness probes while draining
+  g.setState(stateDraining)
+
+  // end long-running servlet responses, like event streams, so that
+  // in-flight requests can complete
+  for _, site := range g.allSites() {
+    site.signalStop()
+  }
+
+  var incomplete []string
+
+  if err := g.servers.Shutdown(c.Timeout); err != nil {
     logf("error shutting down servers: %v", err)
+    if err == context.DeadlineExceeded {
+      err = errorf("requests did not complete within %s", c.Timeout)
+    }
+    incomplete = append(incomplete, err.Error())
   }
 
   // shut down all servlets
-  if g.servletCache != nil {
-    g.servletCache.Shutdown()
+  for _, site := range g.allSites() {
+    if err := site.Shutdown(); err != nil {
+      logf("error shutting down servlets: %v", err)
+      incomplete = append(incomplete, err.Error())
+    }
   }
 
   // close zdr
@@ -144,27 +257,37 @@ func (g *Ghp) Shutdown() {
     g.zdr.Close()
   }
 
+  if len(incomplete) > 0 {
+    return &shutdownError{ incomplete }
+  }
   if devMode {
     logf("graceful shutdown completed")
   }
+  return nil
 }
 
 
-func (g *Ghp) initServlets(c *ServletConfig) error {
-  builddir := pjoin(g.appBuildDir, "servlet")
-
-  if !c.Recycle {
-    os.RemoveAll(builddir)
+// awaitShutdown waits for a graceful shutdown in progress, if any, to
+// complete and returns its result
+//
+func (g *Ghp) awaitShutdown() error {
+  if atomic.LoadInt32(&g.state) != stateDraining {
+    return nil
   }
+  <-g.shutdownDone
+  return g.shutdownErr
+}
 
-  // setup servlet cache
-  g.servletCache = NewServletCache(g, c, builddir)
 
-  if c.Preload {
-    return g.servletCache.LoadAll()
-  }
+// shutdownError is returned from Ghp.Shutdown when connections had to be
+// closed or servlets failed to stop in time
+//
+type shutdownError struct {
+  reasons []string
+}
 
-  return nil
+func (e *shutdownError) Error() string {
+  return "incomplete shutdown: " + strings.Join(e.reasons, "; ")
 }
 
 
@@ -197,27 +320,37 @@ func (g *Ghp) initAppCacheDir() {
   if strings.HasPrefix(g.config.CacheDir, ghpdir) {
     // CacheDir is rooted in the shared ghpdir, so add on pubdirId,
     // unique to each pubdir.
-    sha1sum := sha1.Sum([]byte(g.config.PubDir))
-    pubdirId := base64.RawURLEncoding.EncodeToString(sha1sum[:])
-    pubDirV := strings.Split(g.config.PubDir, string(filepath.Separator))
-    pubDirFrag := strings.Join(pubDirV[imax(0, len(pubDirV)-2):], "-") + "-"
-    slugRe := regexp.MustCompile(`[^0-9A-Za-z_]+`)
-    pubdirId = slugRe.ReplaceAllString(pubDirFrag, "-") + pubdirId
-
-    g.appCacheDir = pjoin(g.config.CacheDir, pubdirId)
+    g.appCacheDir = pjoin(g.config.CacheDir, pubdirId(g.config.PubDir))
   }
+  g.appBuildDir = pjoin(g.appCacheDir, appBuildDirname())
+}
+
 
+// pubdirId returns a directory name unique to pubdir
+//
+func pubdirId(pubdir string) string {
+  sha1sum := sha1.Sum([]byte(pubdir))
+  id := base64.RawURLEncoding.EncodeToString(sha1sum[:])
+  pubDirV := strings.Split(pubdir, string(filepath.Separator))
+  pubDirFrag := strings.Join(pubDirV[imax(0, len(pubDirV)-2):], "-") + "-"
+  slugRe := regexp.MustCompile(`[^0-9A-Za-z_]+`)
+  return slugRe.ReplaceAllString(pubDirFrag, "-") + id
+}
+
+
+// appBuildDirname returns the name of the build directory, which is
+// unique to the runtime.
+//
+func appBuildDirname() string {
   // runtime tag used for build folder.
   // Note: We assume that the go compiler and environment used to build GHP
   // is also being used to build servlets. We probably need to guarantee this
   // anyways, but this comment is here as a -CAUTION- for now.
-  buildDirname := fmt.Sprintf(
+  return fmt.Sprintf(
     "build.%s-%s-%s-%s",
     runtime.Version(),
     runtime.Compiler,
     runtime.GOOS,
     runtime.GOARCH,
   )
-
-  g.appBuildDir = pjoin(g.appCacheDir, buildDirname)
 }
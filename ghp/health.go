@@ -0,0 +1,105 @@
+package main
+
+import (
+  "net/http"
+  "strings"
+  "sync/atomic"
+)
+
+// Lifecycle states of a GHP process, reported by the readiness endpoint
+//
+const (
+  stateStarting = int32(iota)  // preloading servlets, acquiring listeners
+  stateReady                   // serving
+  stateDraining                // graceful shutdown has begun
+)
+
+
+func (g *Ghp) setState(state int32) {
+  atomic.StoreInt32(&g.state, state)
+}
+
+
+// beginAcquire is called by Main before acquiring listeners. Returns false
+// if a shutdown has canceled startup.
+//
+func (g *Ghp) beginAcquire() bool {
+  g.startmu.Lock()
+  defer g.startmu.Unlock()
+  if atomic.LoadInt32(&g.state) != stateStarting {
+    return false
+  }
+  g.acquiring = true
+  return true
+}
+
+
+// cancelStart cancels startup, unless Main is past beginAcquire
+//
+func (g *Ghp) cancelStart() {
+  g.startmu.Lock()
+  defer g.startmu.Unlock()
+  if atomic.LoadInt32(&g.state) == stateStarting && !g.acquiring {
+    g.setState(stateDraining)
+  }
+}
+
+
+// endStart signals that Main is done starting, successfully or not
+//
+func (g *Ghp) endStart() {
+  g.startOnce.Do(func() { close(g.startDone) })
+}
+
+
+// readiness returns nil if the process is ready to serve requests, or
+// the reasons it's not
+//
+func (g *Ghp) readiness() []string {
+  switch atomic.LoadInt32(&g.state) {
+  case stateStarting:
+    return []string{"starting"}
+  case stateDraining:
+    return []string{"draining"}
+  }
+  // only names, as probes are public. Errors are logged and on the admin
+  // status page.
+  var reasons []string
+  for _, site := range g.allSites() {
+    for _, name := range site.preloadFailures() {
+      reasons = append(reasons, "servlet failed to preload: " + name)
+    }
+  }
+  return reasons
+}
+
+
+// serveHealth answers liveness and readiness probes, without touching
+// pub-dir. Returns true if r was for either.
+//
+func (s *HttpServer) serveHealth(w *HttpResponse, r *http.Request) bool {
+  c := &s.g.config.Health
+  status := http.StatusOK
+  body := "ok\n"
+  // an unset path must not match e.g. CONNECT requests, which have none
+  switch {
+  case c.Liveness != "" && r.URL.Path == c.Liveness:
+    // the process is able to serve requests
+  case c.Readiness != "" && r.URL.Path == c.Readiness:
+    if reasons := s.g.readiness(); len(reasons) > 0 {
+      status = http.StatusServiceUnavailable
+      body = strings.Join(reasons, "\n") + "\n"
+    }
+  default:
+    return false
+  }
+  w.setHandler("health", "")
+  h := w.Header()
+  h.Set("Content-Type", "text/plain; charset=utf-8")
+  h.Set("Cache-Control", "no-store")
+  w.WriteHeader(status)
+  if r.Method != "HEAD" {
+    w.WriteString(body)
+  }
+  return true
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+  "net/http"
+  "net/http/httptest"
+  "testing"
+)
+
+
+func TestServeHealth(t *testing.T) {
+  s, cleanup := newTestServer(t, map[string]string{
+    "index.html": "home",
+  }, `
+health:
+  readiness: /readyz
+`)
+  defer cleanup()
+  g, site := s.g, s.g.site
+  site.servletCache = NewServletCache(site, &ServletConfig{}, "")
+  site.middlewareCache = NewMiddlewareCache(site, &ServletConfig{}, "")
+
+  get := func(method, target string) *httptest.ResponseRecorder {
+    w := httptest.NewRecorder()
+    s.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+    return w
+  }
+  expect := func(w *httptest.ResponseRecorder, status int, body string) {
+    t.Helper()
+    if w.Code != status || w.Body.String() != body {
+      t.Errorf("status %d %q, expected %d %q", w.Code, w.Body.String(), status, body)
+    }
+  }
+
+  expect(get("GET", "/readyz"), http.StatusServiceUnavailable, "starting\n")
+  g.setState(stateReady)
+  expect(get("GET", "/readyz"), http.StatusOK, "ok\n")
+
+  // liveness is disabled and must not answer requests without a path
+  if w := get("CONNECT", "example.com:443"); w.Body.String() == "ok\n" {
+    t.Errorf("CONNECT answered by disabled liveness probe")
+  }
+
+  // a failed servlet is reported by name until it builds, even if evicted
+  site.preloadFailed = []string{"api"}
+  site.servletCache.failed["api"] = true
+  expect(get("GET", "/readyz"), http.StatusServiceUnavailable,
+    "servlet failed to preload: api\n")
+  delete(site.servletCache.failed, "api")
+  expect(get("GET", "/readyz"), http.StatusOK, "ok\n")
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+  "bufio"
+  "net"
+  "net/http"
+  "sync"
+  "time"
+)
+
+
+// hijackedConn is a connection taken over by a servlet, e.g. for a
+// WebSocket. It is tracked by the server and servlet so that it can be
+// closed when either is stopped.
+//
+type hijackedConn struct {
+  net.Conn
+  s       *HttpServer
+  servlet *Servlet  // nil if not hijacked by a servlet
+
+  mu         sync.Mutex
+  closed     bool
+  onShutdown func()
+}
+
+
+func (c *hijackedConn) Close() error {
+  c.mu.Lock()
+  if c.closed {
+    c.mu.Unlock()
+    return nil
+  }
+  c.closed = true
+  c.mu.Unlock()
+  c.s.hijacked.remove(c)
+  if c.servlet != nil {
+    c.servlet.conns.remove(c)
+  }
+  return c.Conn.Close()
+}
+
+
+// OnShutdown registers fn to be called instead of Close when the connection
+// is closed because the server or servlet is stopping. fn should close the
+// connection, e.g. after sending a protocol-specific "going away" message.
+//
+func (c *hijackedConn) OnShutdown(fn func()) {
+  c.mu.Lock()
+  c.onShutdown = fn
+  c.mu.Unlock()
+}
+
+
+func (c *hijackedConn) shutdown() {
+  c.mu.Lock()
+  fn := c.onShutdown
+  c.mu.Unlock()
+  if fn != nil {
+    fn()
+  }
+  c.Close()
+}
+
+// ---------------------------------------------------------------------------
+
+// connSet is a set of hijacked connections
+//
+type connSet struct {
+  mu sync.Mutex
+  m  map[*hijackedConn]struct{}
+}
+
+
+func (s *connSet) add(c *hijackedConn) {
+  s.mu.Lock()
+  if s.m == nil {
+    s.m = make(map[*hijackedConn]struct{})
+  }
+  s.m[c] = struct{}{}
+  s.mu.Unlock()
+}
+
+
+func (s *connSet) remove(c *hijackedConn) {
+  s.mu.Lock()
+  delete(s.m, c)
+  s.mu.Unlock()
+}
+
+
+func (s *connSet) Len() int {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  return len(s.m)
+}
+
+
+// shutdownAll shuts down all connections in the set, in parallel
+//
+func (s *connSet) shutdownAll() {
+  s.mu.Lock()
+  conns := make([]*hijackedConn, 0, len(s.m))
+  for c := range s.m {
+    conns = append(conns, c)
+  }
+  s.mu.Unlock()
+
+  var wg sync.WaitGroup
+  for _, c := range conns {
+    wg.Add(1)
+    go func(c *hijackedConn) {
+      defer wg.Done()
+      c.shutdown()
+    }(c)
+  }
+  wg.Wait()
+}
+
+// ---------------------------------------------------------------------------
+
+// Hijack lets the caller take over the connection.
+// The connection's deadlines are cleared and it is tracked by the server,
+// and by the servlet serving the response, if any.
+// Implements http.Hijacker and ghp.Response
+//
+func (w *HttpResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+  hj, ok := w.ResponseWriter.(http.Hijacker)
+  if !ok {
+    return nil, nil, errorf("connection does not support hijacking")
+  }
+  if w.outer != nil {
+    // passed on through middleware to the root response, which tracks
+    // the connection
+    w.outer.servlet = w.servlet
+    return hj.Hijack()
+  }
+  conn, rw, err := hj.Hijack()
+  if err != nil {
+    return nil, nil, err
+  }
+
+  // long-lived connections should not be subject to server timeouts, and
+  // are limited by max-connections rather than max-requests
+  conn.SetDeadline(time.Time{})
+  w.releaseRequest()
+
+  if w.status == 0 {
+    w.status = http.StatusSwitchingProtocols
+  }
+
+  hc := &hijackedConn{ Conn: conn, s: w.s, servlet: w.servlet }
+  w.s.hijacked.add(hc)
+  if hc.servlet != nil {
+    hc.servlet.conns.add(hc)
+  }
+  return hc, rw, nil
+}
+
+
+// ClearDeadlines exempts the response from the server's read and write
+// timeouts, for long-lived responses like event streams.
+//
+func (w *HttpResponse) ClearDeadlines() {
+  w.s.clearDeadlines(w.r)
+  w.releaseRequest()
+}
+
+
+// onConnState is called by http.Server when a connection changes state.
+// It maintains s.conns.
+//
+func (s *HttpServer) onConnState(c net.Conn, state http.ConnState) {
+  s.connsmu.Lock()
+  defer s.connsmu.Unlock()
+  switch state {
+  case http.StateNew:
+    if s.conns == nil {
+      s.conns = make(map[net.Conn]bool)
+    }
+    s.conns[c] = true
+  case http.StateHijacked, http.StateClosed:
+    delete(s.conns, c)
+  }
+}
+
+
+// clearDeadlines removes read and write deadlines from the connection
+// of request r, exempting the request from the server's timeouts.
+//
+func (s *HttpServer) clearDeadlines(r *http.Request) {
+  if c := connOfRequest(r); c != nil {
+    c.SetReadDeadline(time.Time{})
+    c.SetWriteDeadline(time.Time{})
+  }
+}
+
+
+// connOfRequest returns the connection r was received on, or nil if it was
+// not accepted by a requestConnListener
+//
+func connOfRequest(r *http.Request) net.Conn {
+  if a, ok := r.Context().Value(http.LocalAddrContextKey).(*connAddr); ok {
+    return a.conn
+  }
+  return nil
+}
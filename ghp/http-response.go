@@ -2,12 +2,37 @@ package main
 
 import (
   "fmt"
+  "io"
   "net/http"
   "time"
 )
 
 type HttpResponse struct {
   http.ResponseWriter
+  status      int    // status code sent, or 0 if no header has been written
+  written     int64  // number of body bytes written
+  handlerType string // what served the response, e.g. "page" or "servlet"
+  handlerName string // e.g. page name or servlet name@version
+
+  s    *HttpServer    // server serving the response
+  r    *http.Request  // request being responded to
+  site *Site          // site serving the request. nil until known
+  servlet *Servlet    // servlet serving the request, if any
+  release func()      // releases request slot. nil without max-requests
+  body    io.ReadCloser  // request body without size limit
+  outer   *HttpResponse  // response wrapped by middleware. See passedOn
+  authorized *AuthConfig // auth rule the request has passed, if any
+}
+
+
+// root returns the response created by the server, which w is or which
+// middleware has wrapped
+//
+func (w *HttpResponse) root() *HttpResponse {
+  if w.outer != nil {
+    return w.outer
+  }
+  return w
 }
 
 // setLastModified sets Last-Modified header if modtime != 0
@@ -18,6 +43,50 @@ func (w *HttpResponse) setLastModified(modtime time.Time) {
   }
 }
 
+// setHandler records what is serving the response, for logging
+//
+func (w *HttpResponse) setHandler(typ, name string) {
+  w.handlerType = typ
+  w.handlerName = name
+  if w.outer != nil {
+    w.outer.setHandler(typ, name)
+  }
+}
+
+// Status returns the status code of the response.
+// Returns 200 if no header has been written, as that's what would be sent.
+//
+func (w *HttpResponse) Status() int {
+  if w.status == 0 {
+    return http.StatusOK
+  }
+  return w.status
+}
+
+func (w *HttpResponse) WriteHeader(statusCode int) {
+  if w.status == 0 {
+    w.status = statusCode
+  }
+  w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *HttpResponse) Write(b []byte) (int, error) {
+  if w.status == 0 {
+    w.status = http.StatusOK
+  }
+  n, err := w.ResponseWriter.Write(b)
+  w.written += int64(n)
+  return n, err
+}
+
+// WriteError responds with the error page for statusCode.
+// err is optional and only included in the response in development mode.
+// Implements ghp.Response
+//
+func (w *HttpResponse) WriteError(statusCode int, err error) {
+  w.s.replyStatus(w, statusCode, err)
+}
+
 func (w *HttpResponse) WriteString(s string) (int, error) {
   return w.Write([]byte(s))
 }
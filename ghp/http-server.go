@@ -13,10 +13,15 @@ import (
   "runtime/debug"
   "strconv"
   "strings"
+  "sync"
+  "sync/atomic"
   "time"
 
   "github.com/rsms/ghp"
   "golang.org/x/crypto/acme/autocert"
+  "golang.org/x/net/http2"
+  "golang.org/x/net/http2/h2c"
+  "golang.org/x/net/netutil"
 )
 
 
@@ -40,6 +45,64 @@ func (ln tcpKeepAliveListener) Accept() (net.Conn, error) {
 }
 
 
+// unixConnListener gives each accepted unix socket connection a unique
+// remote address, as the peers of unix sockets are usually unnamed.
+//
+type unixConnListener struct {
+  *net.UnixListener
+  nextid uint64
+}
+
+type unixConn struct {
+  *net.UnixConn
+  raddr net.Addr
+}
+
+func (c *unixConn) RemoteAddr() net.Addr { return c.raddr }
+
+func (ln *unixConnListener) Accept() (net.Conn, error) {
+  uc, err := ln.AcceptUnix()
+  if err != nil {
+    return nil, err
+  }
+  id := atomic.AddUint64(&ln.nextid, 1)
+  raddr := &net.UnixAddr{ Net: "unix", Name: "@" + strconv.FormatUint(id, 10) }
+  return &unixConn{uc, raddr}, nil
+}
+
+
+// requestConnListener makes the connection of a request known to its
+// handler, which r.RemoteAddr doesn't do, e.g. with the PROXY protocol or
+// HTTP/2. net/http places the local address of a connection in the context
+// of its requests, as http.LocalAddrContextKey, and the local address of
+// accepted connections is a connAddr referring to the connection.
+// See connOfRequest.
+//
+type requestConnListener struct {
+  net.Listener
+}
+
+type requestConn struct {
+  net.Conn
+  laddr *connAddr
+}
+
+type connAddr struct {
+  net.Addr
+  conn net.Conn
+}
+
+func (c *requestConn) LocalAddr() net.Addr { return c.laddr }
+
+func (ln requestConnListener) Accept() (net.Conn, error) {
+  c, err := ln.Listener.Accept()
+  if err != nil {
+    return nil, err
+  }
+  return &requestConn{ c, &connAddr{ c.LocalAddr(), c } }, nil
+}
+
+
 // --------------------------------------------------
 
 type HttpServer struct {
@@ -48,7 +111,17 @@ type HttpServer struct {
   s       *http.Server
   c       *ServerConfig
   dirlist *HtmlDirLister
-  pageIndexName string
+
+  conns    map[net.Conn]bool  // open connections
+  connsmu  sync.Mutex
+  hijacked connSet  // connections taken over by servlets
+  proxies  map[*RouteConfig]*ReverseProxy
+  files    *FileFilter  // private files
+  limiters []*RateLimiter
+  requests *requestLimiter  // nil without max-requests
+
+  metricsOnly bool    // only serves metrics. See MetricsConfig.Address
+  admin       *Admin  // only serves admin when non-nil. See AdminConfig
 }
 
 
@@ -58,12 +131,10 @@ func NewHttpServer(g *Ghp, c *ServerConfig) *HttpServer {
     c: c,
   }
 
-  if g.pageCache != nil {
-    s.pageIndexName = "index" + g.pageCache.fileext
-  }
-
   addr := c.Address
-  if strings.IndexByte(addr, ':') < 0 {
+  if c.network() == "unix" {
+    addr = addr[len("unix:"):]
+  } else if strings.IndexByte(addr, ':') < 0 {
     if s.c.Type == "https" {
       addr += ":443"
     } else {
@@ -73,21 +144,68 @@ func NewHttpServer(g *Ghp, c *ServerConfig) *HttpServer {
 
   s.s = &http.Server{
     Addr:           addr,
-    ReadTimeout:    10 * time.Second,
-    WriteTimeout:   10 * time.Second,
+    ReadTimeout:    durationOr(c.ReadTimeout, 10 * time.Second),
+    WriteTimeout:   durationOr(c.WriteTimeout, 10 * time.Second),
+    IdleTimeout:    durationOr(c.IdleTimeout, 0),
     MaxHeaderBytes: 1 << 20,
     ErrorLog:       logger,
     Handler:        s,
+    ConnState:      s.onConnState,
   }
 
-  // s.s.RegisterOnShutdown(s.onShutdown)
+  s.s.RegisterOnShutdown(s.onShutdown)
+
+  s.files = NewFileFilter("/",
+    concatStrings(defaultDeny, g.config.Deny, c.Deny),
+    concatStrings(defaultAllow, g.config.Allow, c.Allow),
+  )
+
+  if c.MaxRequests > 0 {
+    s.requests = newRequestLimiter(c.MaxRequests,
+      durationOr(c.QueueTimeout, 1 * time.Second))
+  }
+
+  for _, rl := range c.RateLimits {
+    s.limiters = append(s.limiters, NewRateLimiter(rl, c.trustedProxies))
+  }
+
+  for _, rc := range c.Routes {
+    if rc.Proxy != "" {
+      if s.proxies == nil {
+        s.proxies = make(map[*RouteConfig]*ReverseProxy)
+      }
+      s.proxies[rc] = NewReverseProxy(s, rc)
+    }
+  }
+
+  if c.Type == "h2c" {
+    // HTTP/2 without TLS, either with prior knowledge or by upgrading
+    // HTTP/1.1 connections with "Upgrade: h2c".
+    // ConfigureServer makes s.s.Shutdown gracefully shut down HTTP/2
+    // connections, which are hijacked from s.s by the h2c handler.
+    h2s := &http2.Server{}
+    if err := http2.ConfigureServer(s.s, h2s); err != nil {
+      logf("[%v] failed to configure http2: %v", s, err)
+    }
+    s.s.Handler = h2c.NewHandler(s, h2s)
+  }
 
   return s
 }
 
 
 func (s *HttpServer) String() string {
-  return "HttpServer(" + s.c.Type + "://" + s.s.Addr + ")"
+  return "HttpServer(" + s.c.Type + "://" + s.displayAddr() + ")"
+}
+
+
+// displayAddr returns the address, prefixed with "unix:" for unix sockets
+//
+func (s *HttpServer) displayAddr() string {
+  if s.Network() == "unix" {
+    return "unix:" + s.s.Addr
+  }
+  return s.s.Addr
 }
 
 
@@ -108,12 +226,29 @@ func (s *HttpServer) Serve() error {
     s.dirlist = nil
   }
 
+  for _, p := range s.proxies {
+    p.Start()
+  }
+
   // wrap TCP listeners in tcpKeepAliveListener to properly configure
   // keep-alive for accepted connections.
   ln := s.l
-  if tcpln, ok := ln.(*net.TCPListener); ok {
+  tcpln, isTCP := ln.(*net.TCPListener)
+  if isTCP {
     ln = &tcpKeepAliveListener{tcpln}
+  } else if unixln, ok := ln.(*net.UnixListener); ok {
+    ln = &unixConnListener{ UnixListener: unixln }
+  }
+  if s.c.MaxConnections > 0 {
+    // connections over the limit wait in the listen backlog. The limit is
+    // below the PROXY protocol so that connections count while their
+    // header is read.
+    ln = netutil.LimitListener(ln, s.c.MaxConnections)
+  }
+  if isTCP && s.c.ProxyProtocol {
+    ln = newProxyProtocolListener(ln, s.c.trustedProxies)
   }
+  ln = requestConnListener{ln}
 
   if s.c.Type == "https" {
     return s.serveHttps(ln)
@@ -123,11 +258,30 @@ func (s *HttpServer) Serve() error {
 }
 
 
+// Addr returns the listen address; "host:port" or a unix socket path
+//
 func (s *HttpServer) Addr() string {
   return s.s.Addr
 }
 
 
+// Network returns "tcp" or "unix"
+//
+func (s *HttpServer) Network() string {
+  return s.c.network()
+}
+
+
+// unlinkSocket removes the socket file of a unix listener still owned by s,
+// i.e. one which has not been handed over to another process by zdr.
+//
+func (s *HttpServer) unlinkSocket() {
+  if s.l != nil && s.Network() == "unix" {
+    os.Remove(s.Addr())
+  }
+}
+
+
 func (s *HttpServer) serveHttps(l net.Listener) error {
   var certFile, keyFile string
   if s.c.Autocert != nil {
@@ -145,7 +299,7 @@ func (s *HttpServer) serveHttps(l net.Listener) error {
       return err
     }
   }
-  logf("listening on https://%s", s.s.Addr)
+  logf("listening on https://%s", s.displayAddr())
   return s.s.ServeTLS(l, certFile, keyFile)
 }
 
@@ -161,28 +315,43 @@ func (s *HttpServer) serveHttp(l net.Listener) error {
   if s.c.Autocert != nil {
     logf("warning: server config with unused autocert config (not https)")
   }
-  logf("listening on http://%s", s.s.Addr)
+  logf("listening on %s://%s", s.c.Type, s.displayAddr())
   return s.s.Serve(l)
 }
 
 
 func (s *HttpServer) Close() error {
-  return s.s.Close()
+  err := s.s.Close()
+  s.hijacked.shutdownAll()
+  s.closeProxies()
+  s.unlinkSocket()
+  return err
 }
 
 
 func (s *HttpServer) Shutdown(ctx context.Context) error {
-  return s.s.Shutdown(ctx)
+  err := s.s.Shutdown(ctx)
+  s.closeProxies()
+  s.unlinkSocket()
+  return err
+}
+
+
+func (s *HttpServer) closeProxies() {
+  for _, p := range s.proxies {
+    p.Close()
+  }
 }
 
 
-// func (s *HttpServer) onShutdown() {
-//   logf("HttpServer.onShutdown")
-//   // This can be used to gracefully shutdown connections that have undergone
-//   // NPN/ALPN protocol upgrade or that have been hijacked.
-//   // This function should start protocol-specific graceful shutdown, but
-//   // should not wait for shutdown to complete.
-// }
+// onShutdown is called by s.s.Shutdown to gracefully shut down connections
+// that have been hijacked, e.g. WebSockets.
+// This function should start protocol-specific graceful shutdown, but
+// should not wait for shutdown to complete.
+//
+func (s *HttpServer) onShutdown() {
+  go s.hijacked.shutdownAll()
+}
 
 
 func (s *HttpServer) configureAutocert() error {
@@ -215,7 +384,45 @@ func (s *HttpServer) configureAutocert() error {
 
 
 func (s *HttpServer) ServeHTTP(w_ http.ResponseWriter, r *http.Request) {
-  w := &HttpResponse{w_}
+  w := &HttpResponse{ResponseWriter: w_, s: s}
+
+  // record metrics and log request when completed
+  start := time.Now()
+  httpRequestsInFlight.Add(1)
+  defer func() {
+    httpRequestsInFlight.Add(-1)
+    s.observeRequest(w, start)
+    if s.g.accessLog != nil {
+      s.g.accessLog.Log(r, w, start)
+    }
+  }()
+
+  if s.serveHealth(w, r) || s.serveMetrics(w, r) {
+    return
+  }
+  if s.admin != nil {
+    s.admin.ServeHTTP(w, r)
+    return
+  }
+
+  // shed load when too many requests are in flight
+  if !s.limitRequest(w, r) {
+    return
+  }
+  defer w.releaseRequest()
+
+  if s.c.MaxBodySize > 0 {
+    w.limitBody(r, s.c.MaxBodySize)
+  }
+
+  // compress response on the fly. Responses are wrapped even when the
+  // client accepts no encoding, to get "Vary: Accept-Encoding".
+  if c := &s.g.config.Compression; c.Enabled && r.Header.Get("Range") == "" {
+    enc := negotiateEncoding(r.Header.Get("Accept-Encoding"), c.Encodings)
+    cw := newCompressResponseWriter(w_, c, enc, r.Method == "HEAD")
+    w.ResponseWriter = cw
+    defer cw.Close()
+  }
 
   // handle panics and use as reply in development mode
   if devMode {
@@ -232,76 +439,136 @@ func (s *HttpServer) ServeHTTP(w_ http.ResponseWriter, r *http.Request) {
   // func (s *HttpServer) serve(w *HttpResponse, r *http.Request) error
   // and wrap in ServeHTTP to simplify replyError
 
-  // log request
-  logf("%s %s (%s, %s, %s)",
-    r.Method,
-    r.URL.RequestURI(),
-    r.Proto,
-    r.Host,
-    r.RemoteAddr)
+  // attach request state, accessible to servlets and pages
+  st := &ghp.RequestState{
+    ClientIP: s.c.trustedProxies.ClientIP(r),
+  }
+  r = r.WithContext(context.WithValue(r.Context(), ghp.RequestStateKey, st))
+  w.r = r
+
+  // net/http doesn't clean request paths. Clean it here so that e.g.
+  // "/a//b" and "/a/x/../b" are rate limited, authorized, routed and
+  // resolved as "/a/b".
+  if p := cleanURLPath(r.URL.Path); p != r.URL.Path {
+    u := *r.URL
+    u.Path = p
+    u.RawPath = ""
+    r.URL = &u
+  }
+  st.OriginalURL = r.URL
+
+  // select site by Host header
+  site := s.g.siteForHost(r.Host)
+  w.site = site
 
-  // join request path together with pubdir
-  // note that URL.Path never contains ".."
-  fspath := filepath.Join(s.g.config.PubDir, r.URL.Path)
+  // limit request rate of clients
+  if !s.rateLimit(w, r, r.URL.Path) {
+    return
+  }
+
+  // password-protected paths. Routes and proxies are protected by the
+  // request path; files by their pub-dir path as well, once resolved.
+  if !s.authorize(w, r, st, r.URL.Path) {
+    return
+  }
+
+  // apply any matching route, which may rewrite r.URL
+  if s.route(w, r, st) {
+    return
+  }
+
+  // a rewritten path may be protected by another rule
+  if r.URL.Path != st.OriginalURL.Path && !s.authorize(w, r, st, r.URL.Path) {
+    return
+  }
 
-  // attempt to open requested file
-  file, err := os.Open(fspath)
+  // join request path together with pubdir. The path is clean, also
+  // when rewritten.
+  fspath := filepath.Join(site.pubdir, filepath.FromSlash(r.URL.Path))
+
+  // load configuration of the directory of the requested path
+  dirpath := fspath
+  if !strings.HasSuffix(r.URL.Path, "/") {
+    dirpath = filepath.Dir(fspath)
+  }
+  dc, err := site.dirConfigs.Get(dirpath)
   if err != nil {
-    // we can't read the file. Why doesn't really matter. Send 404
+    s.replyError(w, err)
+    return
+  }
+
+  // private files, like servlet sources, are never served
+  if dc.Denied(r.URL.Path, s.files, site.files) {
     s.replyNotFound(w)
     return
   }
-  defer file.Close()
 
-  // read file stats
-  d, err := file.Stat()
+  dc.applyHeaders(w.Header())
+
+  // find the file, page, servlet or listing serving fspath
+  res, err := s.resolve(site, dc, dirpath, fspath, r)
   if err != nil {
     s.replyError(w, err)
     return
   }
+  defer res.Close()
 
-  if d.IsDir() {
-    // TODO: consider using filepath.Walk instead
-
-    // directory -- look for an "index" file
-    names, err := file.Readdirnames(0)
-    if err != nil {
-      s.replyError(w, err)
+  // the resource may be protected by another rule than the request path,
+  // e.g. "/secret.html" served for the clean URL "/secret"
+  if urlpath := res.urlPath(site); urlpath != "" && urlpath != r.URL.Path {
+    if !s.authorize(w, r, st, urlpath) {
       return
     }
+  }
 
-    for _, name := range names {
-      // Note: We need to test for page before index.html as the page
-      // file extension might be ".html"
-      if s.g.pageCache != nil && name == s.pageIndexName {
-        s.servePageFile(pjoin(fspath, name), w, r)
-        return
-      }
-      if name == "index.html" {
-        http.ServeFile(w, r, pjoin(fspath, name))
-        return
-      }
-      if s.g.servletCache != nil && name == "servlet.go" {
-        s.serveServlet(fspath, d, w, r)
-        return
-      }
-    }
+  // pass the request through any middleware in the directories of the
+  // resource, which may be in another directory than the request path,
+  // e.g. the fallback of a single-page app
+  mwpath := fspath
+  if res.fspath != "" {
+    mwpath = res.fspath
+  }
+  chain, err := site.middlewareFor(mwpath)
+  if err != nil {
+    s.replyError(w, err)
+    return
+  }
+  serve := func(w *HttpResponse, r *http.Request) {
+    s.serveResource(site, dc, res, w, r)
+  }
+  if len(chain) > 0 {
+    s.serveMiddleware(chain, w, r, serve)
+  } else {
+    serve(w, r)
+  }
+}
 
-    // directory does not contain any index file
-    if s.dirlist != nil {
-      s.serveDirListing(file, d, w, r)
-    } else {
-      s.replyNotFound(w)
-    }
 
-  } else {
-    // file
-    ext := filepath.Ext(fspath)
-    if s.g.pageCache != nil && ext == s.g.pageCache.fileext {
-      s.servePage(file, d, w, r)
-    } else {
-      s.serveFile(file, d, w, r)
+// serveResource serves res, resolved from a request path in a directory
+// with configuration dc
+//
+func (s *HttpServer) serveResource(site *Site, dc *dirConfig, res *resource, w *HttpResponse, r *http.Request) {
+  // the directory's own configuration applies to its index and listing
+  if res.dc != dc {
+    res.dc.applyHeaders(w.Header())
+  }
+
+  switch res.kind {
+  case resFile:
+    s.serveFile(res.file, res.d, w, r)
+  case resPage:
+    s.servePage(site, res.file, res.d, w, r)
+  case resServlet:
+    if res.pathInfo != "" {
+      requestState(r).PathInfo = res.pathInfo
     }
+    s.serveServlet(site, res.fspath, res.d, w, r)
+  case resDirList:
+    s.serveDirListing(site, res.dirlist, res.dc, res.file, res.d, w, r)
+  case resRedirect:
+    s.replyLocalRedirect(w, r, res.location)
+  default:
+    s.replyNotFound(w)
   }
 }
 
@@ -309,39 +576,65 @@ func (s *HttpServer) ServeHTTP(w_ http.ResponseWriter, r *http.Request) {
 // serveServlet serves a request for a servlet.
 // A servlet is always a directory with a servlet.go file.
 //
-func (s *HttpServer) serveServlet(fspath string, d os.FileInfo, w *HttpResponse, r *http.Request) {
-  // redirect if requested path is not canonical
-  // TODO if we allow URL rerouting, this needs to be aware of it.
-  if s.canonicalizeDirPath(w, r, r.URL.Path) {
+func (s *HttpServer) serveServlet(site *Site, fspath string, d os.FileInfo, w *HttpResponse, r *http.Request) {
+  // redirect if requested path is not canonical.
+  // Requests for paths below the servlet directory are left as-is.
+  st := requestState(r)
+  if (st == nil || st.PathInfo == "") && s.canonicalizeDirPath(w, r, r.URL.Path) {
     return
   }
 
   // get filename relative to pubdir
-  filename, err := filepath.Rel(s.g.config.PubDir, fspath)
+  filename, err := filepath.Rel(site.pubdir, fspath)
   if err != nil {
     s.replyError(w, err)
     return
   }
 
-  servlet, err := s.g.servletCache.Get(filename)
+  servlet, err := site.servletCache.Get(filename)
   if err != nil {
     s.replyError(w, err)
   } else if servlet.serveHTTP == nil {
     s.replyError(w, "missing ServeHTTP in servlet")
   } else {
+    w.setHandler("servlet", servlet.name + "@" + servlet.ctx.Version())
+    w.servlet = servlet
+    if servlet.maxBodySize != 0 {
+      w.limitBody(r, servlet.maxBodySize)
+    }
+    if st != nil {
+      st.Stopping = servlet.stopping
+    }
     req := (*ghp.Request)(r)
     servlet.serveHTTP(req, w)
   }
 }
 
 
-func (s *HttpServer) serveDirListing(f *os.File, d os.FileInfo, w *HttpResponse, r *http.Request) {
+// dirLister returns the directory lister to use for site, or nil if
+// directory listing is disabled.
+//
+func (s *HttpServer) dirLister(site *Site, dc *dirConfig) *HtmlDirLister {
+  if dc != nil && dc.dirlistSet {
+    return dc.dirlist
+  }
+  if site.c.DirList != nil {
+    return site.dirlist
+  }
+  return s.dirlist
+}
+
+
+func (s *HttpServer) serveDirListing(site *Site, dirlist *HtmlDirLister, dc *dirConfig, f *os.File, d os.FileInfo, w *HttpResponse, r *http.Request) {
   // redirect if requested path is not canonical
   if s.canonicalizeDirPath(w, r, r.URL.Path) {
     return
   }
 
-  html, err := s.dirlist.RenderHtml(f.Name(), r.URL.Path)
+  w.setHandler("dirlist", "")
+  html, err := dirlist.RenderHtml(f.Name(), r.URL.Path, func(urlpath string) bool {
+    return dc.Denied(urlpath, s.files, site.files)
+  })
   if err != nil {
     s.replyError(w, err)
     return
@@ -355,13 +648,18 @@ func (s *HttpServer) serveDirListing(f *os.File, d os.FileInfo, w *HttpResponse,
 
 
 func (s *HttpServer) serveFile(f *os.File, d os.FileInfo, w *HttpResponse, r *http.Request) {
+  w.setHandler("file", "")
+  if s.servePrecompressedFile(f, d, w, r) {
+    return
+  }
   http.ServeContent(w, r, d.Name(), d.ModTime(), f)
 }
 
 
-func (s *HttpServer) servePage(f *os.File, d os.FileInfo, w *HttpResponse, r *http.Request) {
-  p, err := s.g.pageCache.Get(&buildCtx{}, f, d)
+func (s *HttpServer) servePage(site *Site, f *os.File, d os.FileInfo, w *HttpResponse, r *http.Request) {
+  p, err := site.pageCache.Get(&buildCtx{}, f, d)
   if err == nil {
+    w.setHandler("page", p.name)
     err = p.Serve(w, r)
   }
   if err != nil {
@@ -370,75 +668,77 @@ func (s *HttpServer) servePage(f *os.File, d os.FileInfo, w *HttpResponse, r *ht
 }
 
 
-func (s *HttpServer) servePageFile(filename string, w *HttpResponse, r *http.Request) {
-  f, err := os.Open(filename)
-  if err != nil {
-    if os.IsNotExist(err) {
-      s.replyNotFound(w)
-    } else {
-      s.replyError(w, err)
-    }
-    return
-  }
-  defer f.Close()
-
-  d, err := f.Stat()
-  if err != nil {
-    s.replyError(w, err)
-    return
-  }
-
-  s.servePage(f, d, w, r)
+func (s *HttpServer) replyNotFound(w *HttpResponse) {
+  s.replyStatus(w, http.StatusNotFound, nil)
 }
 
 
-
-
-const errBody404 = "<html><body><h1>404 not found</h1></body></html>\n"
-const errBody500 = "<html><body><h1>500 internal server error</h1></body></html>\n"
-
-func (s *HttpServer) replyNotFound(w *HttpResponse) {
-  w.Header().Set("Content-Type", "text/html; charset=utf-8")
-  w.Header().Set("Content-Length", strconv.Itoa(len(errBody404)))
-  w.WriteHeader(http.StatusNotFound)
-  io.WriteString(w, errBody404)
+func (s *HttpServer) replyError(w *HttpResponse, message interface{}) {
+  s.replyStatus(w, http.StatusInternalServerError, message)
 }
 
 
-func (s *HttpServer) replyError(w *HttpResponse, message interface{}) {
-  var msg, details string
+// replyStatus responds with an error page for status.
+// message is an optional error or string, included in the response in
+// development mode.
+//
+// The nearest "<status>.ghp" page is used if there is one, otherwise a
+// built-in page is used.
+//
+func (s *HttpServer) replyStatus(w *HttpResponse, status int, message interface{}) {
+  e := makePageError(message)
 
-  if err, ok := message.(error); ok {
-    msg = err.Error()
-    if e, ok := err.(*GoBuildError); ok {
-      details = e.Details
+  if status >= 500 {
+    msg := ""
+    if e != nil {
+      msg = e.Message
     }
-  } else if s, ok := message.(string); ok {
-    msg = s
+    logf("%d %s: %s", status, strings.ToLower(http.StatusText(status)), msg)
   }
 
-  logf("500 internal server error: %s", msg)
+  if w.status != 0 {
+    // header already sent. Nothing we can do.
+    return
+  }
 
-  body := errBody500
+  if s.serveErrorPage(w, status, e) {
+    return
+  }
 
-  if devMode {
+  body := fmt.Sprintf(
+    "<html><body><h1>%d %s</h1></body></html>\n",
+    status,
+    html.EscapeString(strings.ToLower(http.StatusText(status))),
+  )
+
+  if devMode && e != nil {
     body = fmt.Sprintf(
       "<html><body>" +
-      "<h1>500 internal server error</h1>" +
+      "<h1>%d %s</h1>" +
       "<pre style='white-space:pre-wrap'>%s\n\n%s\n</pre>" +
       "</body></html>\n",
-      html.EscapeString(msg),
-      html.EscapeString(details),
+      status,
+      html.EscapeString(strings.ToLower(http.StatusText(status))),
+      html.EscapeString(e.Message),
+      html.EscapeString(e.Details),
     )
   }
 
   w.Header().Set("Content-Type", "text/html; charset=utf-8")
   w.Header().Set("Content-Length", strconv.Itoa(len(body)))
-  w.WriteHeader(http.StatusInternalServerError)
+  w.WriteHeader(status)
   io.WriteString(w, body)
 }
 
 
+// requestState returns the GHP state attached to r, or nil if there is none.
+//
+func requestState(r *http.Request) *ghp.RequestState {
+  st, _ := r.Context().Value(ghp.RequestStateKey).(*ghp.RequestState)
+  return st
+}
+
+
 // localRedirect gives a Moved Permanently response.
 // It does not convert relative paths to absolute paths like Redirect does.
 //
@@ -454,7 +754,13 @@ func (s *HttpServer) replyLocalRedirect(w *HttpResponse, r *http.Request, newPat
 // canonicalizeDirPath calls replyLocalRedirect and returns true if path does
 // not end in a slash and/or if path is not canoncial (e.g. contains "../")
 //
+// Rewritten requests are never redirected since the public URL is
+// defined by the route, not by the file system.
+//
 func (s *HttpServer) canonicalizeDirPath(w *HttpResponse, r *http.Request, pathname string) bool {
+  if st := requestState(r); st != nil && st.OriginalURL.Path != r.URL.Path {
+    return false
+  }
   cleanedPath := path.Clean(pathname)
   if cleanedPath != "/" {
     cleanedPath = cleanedPath + "/"
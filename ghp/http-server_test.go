@@ -0,0 +1,134 @@
+package main
+
+import (
+  "io/ioutil"
+  "net"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "strings"
+  "testing"
+)
+
+
+// newTestServer creates a server for a temporary pub-dir with files, keyed
+// by path, and configuration conf in ghp.yaml format. The server has the
+// configuration of the first of conf's servers, if any.
+// The returned function removes the pub-dir.
+//
+func newTestServer(t *testing.T, files map[string]string, conf string) (*HttpServer, func()) {
+  pubdir, err := ioutil.TempDir("", "ghp-test")
+  if err != nil {
+    t.Fatal(err)
+  }
+  cleanup := func() { os.RemoveAll(pubdir) }
+  writeTestFiles(t, pubdir, files)
+
+  c := &GhpConfig{}
+  conf = strings.Replace(conf, "${pubdir}", pubdir, -1)
+  if err := c.load(strings.NewReader(conf)); err != nil {
+    cleanup()
+    t.Fatal(err)
+  }
+  initAuthConfigs(c.Auth)
+
+  g := &Ghp{ config: c }
+  g.site = NewSite(g, &SiteConfig{ PubDir: pubdir, Auth: c.Auth })
+  if err := g.site.init(); err != nil {
+    cleanup()
+    t.Fatal(err)
+  }
+  sc := &ServerConfig{ Address: "localhost:0", Type: "http" }
+  if len(c.Servers) > 0 {
+    sc = c.Servers[0]  // e.g. for routes
+  }
+  return NewHttpServer(g, sc), cleanup
+}
+
+
+// testGet performs a GET request for urlpath, with basic auth credentials of
+// user "u" when password is not ""
+//
+func testGet(s *HttpServer, urlpath, password string) *httptest.ResponseRecorder {
+  r := httptest.NewRequest("GET", urlpath, nil)
+  if password != "" {
+    r.SetBasicAuth("u", password)
+  }
+  w := httptest.NewRecorder()
+  s.ServeHTTP(w, r)
+  return w
+}
+
+
+func expectStatus(t *testing.T, w *httptest.ResponseRecorder, urlpath string, status int) {
+  t.Helper()
+  if w.Code != status {
+    t.Errorf("GET %s: status %d, expected %d", urlpath, w.Code, status)
+  }
+}
+
+
+func TestServeStatus(t *testing.T) {
+  s, cleanup := newTestServer(t, map[string]string{
+    "index.html": "home",
+    "about.html": "about",
+  }, `
+pages:
+  enabled: true
+clean-urls:
+  enabled: true
+`)
+  defer cleanup()
+
+  for _, tc := range []struct {
+    urlpath string
+    status  int
+  }{
+    { "/", http.StatusOK },
+    { "/about.html", http.StatusOK },
+    { "/about", http.StatusOK },
+    { "/missing", http.StatusNotFound },
+  } {
+    expectStatus(t, testGet(s, tc.urlpath, ""), tc.urlpath, tc.status)
+  }
+}
+
+
+func TestConnOfRequest(t *testing.T) {
+  tcpln, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  // clients behind a load balancer share a remote address
+  ln := requestConnListener{ newProxyProtocolListener(tcpln, nil) }
+  type result struct {
+    raddr string
+    conn  net.Conn
+  }
+  results := make(chan result, 2)
+  hs := &http.Server{
+    Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      results <- result{ r.RemoteAddr, connOfRequest(r) }
+    }),
+  }
+  go hs.Serve(ln)
+  defer hs.Close()
+
+  for i := 0; i < 2; i++ {
+    c, err := net.Dial("tcp", tcpln.Addr().String())
+    if err != nil {
+      t.Fatal(err)
+    }
+    defer c.Close()
+    c.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 1234 80\r\n" +
+      "GET / HTTP/1.1\r\nHost: x\r\n\r\n"))
+  }
+
+  r1, r2 := <-results, <-results
+  if r1.raddr != r2.raddr {
+    t.Errorf("remote addresses %q and %q, expected the same", r1.raddr, r2.raddr)
+  }
+  if r1.conn == nil || r2.conn == nil || r1.conn == r2.conn {
+    t.Errorf("connections %v and %v, expected two different ones", r1.conn, r2.conn)
+  }
+}
@@ -41,7 +41,7 @@ type IpcMsgReader struct {
 }
 
 func NewIpcMsgReader(r io.Reader) *IpcMsgReader {
-  return &IpcMsgReader{ Decoder: gob.NewDecoder(r) }
+  return &IpcMsgReader{ Decoder: gob.NewDecoder(ipcByteReader{r}) }
 }
 
 func (r IpcMsgReader) Read(cmd string) (*IpcMsg, error) {
@@ -56,3 +56,18 @@ func (r IpcMsgReader) Read(cmd string) (*IpcMsg, error) {
 func (r IpcMsgReader) ReadMsg(m *IpcMsg) error {
   return r.Decoder.Decode(m)
 }
+
+
+// ipcByteReader makes gob.Decoder read exactly one message at a time rather
+// than buffering what follows it, like file descriptors sent over a unix
+// socket, which are lost when read as part of a buffer.
+//
+type ipcByteReader struct {
+  io.Reader
+}
+
+func (r ipcByteReader) ReadByte() (byte, error) {
+  var b [1]byte
+  _, err := io.ReadFull(r.Reader, b[:])
+  return b[0], err
+}
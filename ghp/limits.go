@@ -0,0 +1,103 @@
+package main
+
+import (
+  "net/http"
+  "sync"
+  "time"
+)
+
+
+// requestLimiter limits the number of requests served at once.
+// Requests over the limit wait in line for a while and are then shed.
+//
+type requestLimiter struct {
+  slots   chan struct{}
+  timeout time.Duration  // max time to wait for a slot
+}
+
+
+func newRequestLimiter(max int, timeout time.Duration) *requestLimiter {
+  return &requestLimiter{
+    slots: make(chan struct{}, max),
+    timeout: timeout,
+  }
+}
+
+
+// acquire waits for a free slot. Returns a function which releases the slot
+// and is safe to call more than once, or nil if no slot became available in
+// time or the client went away.
+//
+func (l *requestLimiter) acquire(r *http.Request) func() {
+  select {
+  case l.slots <- struct{}{}:
+  default:
+    if l.timeout <= 0 {
+      return nil
+    }
+    timer := time.NewTimer(l.timeout)
+    defer timer.Stop()
+    select {
+    case l.slots <- struct{}{}:
+    case <-timer.C:
+      return nil
+    case <-r.Context().Done():
+      return nil
+    }
+  }
+  var once sync.Once
+  return func() {
+    once.Do(func() { <-l.slots })
+  }
+}
+
+
+// limitRequest acquires a request slot for r, responding with
+// "503 Service Unavailable" when the server is too busy.
+// Returns false if the request was responded to.
+//
+func (s *HttpServer) limitRequest(w *HttpResponse, r *http.Request) bool {
+  if s.requests == nil {
+    return true
+  }
+  release := s.requests.acquire(r)
+  if release == nil {
+    w.Header().Set("Retry-After", "1")
+    s.replyStatus(w, http.StatusServiceUnavailable, "too many requests in flight")
+    return false
+  }
+  w.release = release
+  return true
+}
+
+
+// releaseRequest frees the request slot of the response, if any.
+// Long-lived responses, like event streams and hijacked connections, release
+// their slot early so they don't count towards max-requests.
+//
+func (w *HttpResponse) releaseRequest() {
+  w = w.root()
+  if w.release != nil {
+    w.release()
+  }
+}
+
+
+// limitBody limits the size of the request body of r to max bytes, or
+// removes the limit if max is negative. Reading past the limit fails and
+// closes the connection after the response. See http.MaxBytesReader.
+//
+func (w *HttpResponse) limitBody(r *http.Request, max int64) {
+  w = w.root()
+  if w.body == nil {
+    w.body = r.Body  // unlimited body
+  }
+  if r.Body == http.NoBody {
+    return
+  }
+  if max < 0 {
+    r.Body = w.body
+  } else {
+    r.Body = http.MaxBytesReader(w.ResponseWriter, w.body, max)
+  }
+}
@@ -26,6 +26,13 @@ var (
   devMode bool
 )
 
+// Exit status of the process
+const (
+  exitOK       = 0  // graceful shutdown completed
+  exitError    = 1  // failed to start or serve
+  exitShutdown = 2  // shutdown cut off requests or servlets
+)
+
 
 func init() {
   logger = log.New(os.Stdout, "", log.LstdFlags | log.LUTC)
@@ -75,42 +82,30 @@ func main() {
   }
 
   // make sure the go tool is available when usign servlets
-  if config.Servlet.Enabled {
+  if config.servletsEnabled() {
     if err := InitGoTool(&config.Go); err != nil {
-      panic(err)
+      fatalf("%v", err)
     }
   }
 
   // Create GHP instance
   ghp, err := NewGhp(ghpdir, config)
   if err != nil {
-    panic(err)
+    fatalf("%v", err)
   }
 
-  // setup SIGHUP signal handler for graceful shutdown
+  // setup signal handler for graceful shutdown
   sigch := make(chan os.Signal, 1)
-  signal.Notify(sigch, syscall.SIGHUP)
-  gotHUP := false
+  signal.Notify(sigch, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
   go func(){
-    for {
-      <-sigch  // await signal
-      if !gotHUP {
-        // first SIGHUP starts graceful shutdown
-        gotHUP = true
-        go ghp.Shutdown()
-      } else {
-        // second SIGHUPs causes immediate close
-        go func() {
-          if err := ghp.Close(); err != nil {
-            panic(err)
-          }
-        }()
-        break
-      }
-    }
-    for {
-      <-sigch
-    }
+    // first signal starts graceful shutdown
+    sig := <-sigch
+    logf("received %v; shutting down", sig)
+    go ghp.Shutdown()
+    // second signal causes immediate exit
+    sig = <-sigch
+    logf("received %v; exiting without waiting for shutdown", sig)
+    Exit(exitShutdown)
   }()
 
   // DEBUG request something from the "example" servlet after 100ms
@@ -122,7 +117,11 @@ func main() {
 
   // Run GHP instance
   if err := ghp.Main(); err != nil {
-    panic(err)
+    logf("%v", err)
+    if _, ok := err.(*shutdownError); ok {
+      Exit(exitShutdown)
+    }
+    Exit(exitError)
   }
 }
 
@@ -0,0 +1,210 @@
+package main
+
+import (
+  "bytes"
+  "fmt"
+  "html"
+  "path/filepath"
+  "strings"
+  template "html/template"
+
+  "github.com/russross/blackfriday/v2"
+)
+
+// markdownDefaultLayout wraps Markdown pages which have no layout page
+//
+const markdownDefaultLayout = `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>{.Title}</title>
+</head>
+<body>
+{.Content}
+</body>
+</html>
+`
+
+
+// markdownDoc is a Markdown document rendered to HTML
+//
+type markdownDoc struct {
+  html     template.HTML
+  title    string  // title from front matter, or text of first heading
+  headings []*markdownHeading
+  toc      template.HTML
+}
+
+
+// markdownHeading is a heading of a Markdown page, available to its
+// layout in .Headings
+//
+type markdownHeading struct {
+  Level int     // 1 for <h1>, 2 for <h2> etc
+  ID    string  // id attribute, for linking to the heading with "#" + ID
+  Title string  // text of the heading
+}
+
+
+// isMarkdown returns true if filename is the source of a Markdown page
+//
+func (c *PageCache) isMarkdown(filename string) bool {
+  return c.mdext != "" && filepath.Ext(filename) == c.mdext
+}
+
+
+// parseMarkdown parses the front matter of Markdown source, if any, and
+// renders the rest to HTML
+//
+func (c *PageCache) parseMarkdown(name, source string) (*markdownDoc, *PageMetadata, error) {
+  meta, metaEndPos, err := parsePageMetadata(name, source)
+  if err != nil {
+    return nil, nil, err
+  }
+  doc := renderMarkdown([]byte(source[metaEndPos:]))
+  if meta != nil {
+    if title, ok := meta.Custom["title"].(string); ok {
+      doc.title = title
+    }
+  }
+  return doc, meta, nil
+}
+
+
+// findLayout returns the pub-dir path of the layout file nearest to the
+// Markdown page filename, looking in its directory and then in each parent
+// directory up to pub-dir. Returns "" if there is none.
+// Also returns the filenames of the layout files looked for which don't
+// exist, as creating one changes the layout of the page.
+//
+func (c *PageCache) findLayout(filename string) (string, []string) {
+  var missing []string
+  dir := filepath.Dir(filename)
+  for strings.HasPrefix(dir, c.srcdir) {
+    layoutfile := pjoin(dir, c.layout)
+    if checkIsFile(layoutfile) == nil {
+      return "/" + filepath.ToSlash(relfile(c.srcdir, layoutfile)), missing
+    }
+    missing = append(missing, layoutfile)
+    if dir == c.srcdir {
+      break
+    }
+    dir = filepath.Dir(dir)
+  }
+  return "", missing
+}
+
+
+// renderMarkdown renders source to HTML, giving each heading a unique id
+//
+func renderMarkdown(source []byte) *markdownDoc {
+  ext := blackfriday.CommonExtensions | blackfriday.AutoHeadingIDs
+  ast := blackfriday.New(blackfriday.WithExtensions(ext)).Parse(source)
+
+  doc := &markdownDoc{}
+  ids := make(map[string]bool)
+  ast.Walk(func(node *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+    if entering && node.Type == blackfriday.Heading && !node.IsTitleblock {
+      h := &markdownHeading{
+        Level: node.Level,
+        ID: uniqueHeadingID(ids, node.HeadingID),
+        Title: markdownText(node),
+      }
+      node.HeadingID = h.ID
+      doc.headings = append(doc.headings, h)
+      return blackfriday.SkipChildren
+    }
+    return blackfriday.GoToNext
+  })
+
+  r := blackfriday.NewHTMLRenderer(blackfriday.HTMLRendererParameters{
+    Flags: blackfriday.CommonHTMLFlags,
+  })
+  var buf bytes.Buffer
+  r.RenderHeader(&buf, ast)
+  ast.Walk(func(node *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+    return r.RenderNode(&buf, node, entering)
+  })
+  r.RenderFooter(&buf, ast)
+
+  doc.html = template.HTML(buf.String())
+  doc.toc = markdownTOC(doc.headings)
+  if len(doc.headings) > 0 {
+    doc.title = doc.headings[0].Title
+  }
+  return doc
+}
+
+
+// uniqueHeadingID returns id, or id with a "-N" suffix if it's already in
+// ids, and adds the result to ids
+//
+func uniqueHeadingID(ids map[string]bool, id string) string {
+  if id == "" {
+    id = "section"  // e.g. a heading of only punctuation
+  }
+  unique := id
+  for n := 1; ids[unique]; n++ {
+    unique = fmt.Sprintf("%s-%d", id, n)
+  }
+  ids[unique] = true
+  return unique
+}
+
+
+// markdownText returns the plain text of node and its children
+//
+func markdownText(node *blackfriday.Node) string {
+  var sb strings.Builder
+  node.Walk(func(n *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+    if entering && (n.Type == blackfriday.Text || n.Type == blackfriday.Code) {
+      sb.Write(n.Literal)
+    }
+    return blackfriday.GoToNext
+  })
+  return sb.String()
+}
+
+
+// markdownTOC returns a table of contents of headings as nested lists of
+// links, nested by heading level
+//
+func markdownTOC(headings []*markdownHeading) template.HTML {
+  if len(headings) == 0 {
+    return ""
+  }
+  minLevel := headings[0].Level
+  for _, h := range headings {
+    if h.Level < minLevel {
+      minLevel = h.Level
+    }
+  }
+
+  // depth is the number of open lists. The item of the last heading is
+  // open at that depth.
+  var sb strings.Builder
+  depth := 0
+  for _, h := range headings {
+    level := h.Level - minLevel + 1
+    if level > depth {
+      for first := true; depth < level; depth, first = depth + 1, false {
+        if depth > 0 && !first {
+          sb.WriteString("<li>")  // skipped heading level
+        }
+        sb.WriteString("<ul>")
+      }
+    } else {
+      for ; depth > level; depth-- {
+        sb.WriteString("</li></ul>")
+      }
+      sb.WriteString("</li>")
+    }
+    fmt.Fprintf(&sb, `<li><a href="#%s">%s</a>`,
+      html.EscapeString(h.ID), html.EscapeString(h.Title))
+  }
+  for ; depth > 0; depth-- {
+    sb.WriteString("</li></ul>")
+  }
+  return template.HTML(sb.String())
+}
+
@@ -0,0 +1,125 @@
+package main
+
+import (
+  "io/ioutil"
+  "net/http"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+
+func TestUniqueHeadingID(t *testing.T) {
+  ids := make(map[string]bool)
+  for _, tc := range []struct {
+    id     string
+    expect string
+  }{
+    { "intro", "intro" },
+    { "intro", "intro-1" },
+    { "intro", "intro-2" },
+    { "", "section" },
+    { "", "section-1" },
+    { "intro-1", "intro-1-1" },
+    { "usage", "usage" },
+  } {
+    if id := uniqueHeadingID(ids, tc.id); id != tc.expect {
+      t.Errorf("%q: %q, expected %q", tc.id, id, tc.expect)
+    }
+  }
+}
+
+
+func TestMarkdownTOC(t *testing.T) {
+  h := func(level int, id, title string) *markdownHeading {
+    return &markdownHeading{ Level: level, ID: id, Title: title }
+  }
+  for _, tc := range []struct {
+    name     string
+    headings []*markdownHeading
+    expect   string
+  }{
+    { "empty", nil, "" },
+    { "flat",
+      []*markdownHeading{ h(2, "a", "A"), h(2, "b", "B") },
+      `<ul><li><a href="#a">A</a></li><li><a href="#b">B</a></li></ul>` },
+    { "nested",
+      []*markdownHeading{ h(1, "a", "A"), h(2, "b", "B"), h(2, "c", "C"), h(1, "d", "D") },
+      `<ul><li><a href="#a">A</a>` +
+        `<ul><li><a href="#b">B</a></li><li><a href="#c">C</a></li></ul>` +
+      `</li><li><a href="#d">D</a></li></ul>` },
+    { "skipped level",
+      []*markdownHeading{ h(2, "a", "A"), h(4, "b", "B") },
+      `<ul><li><a href="#a">A</a><ul><li><ul><li><a href="#b">B</a>` +
+      `</li></ul></li></ul></li></ul>` },
+    { "deeper first",
+      []*markdownHeading{ h(3, "a", "A"), h(2, "b", "B") },
+      `<ul><li><ul><li><a href="#a">A</a></li></ul></li>` +
+      `<li><a href="#b">B</a></li></ul>` },
+    { "escaped",
+      []*markdownHeading{ h(1, "x&y", "a<b") },
+      `<ul><li><a href="#x&amp;y">a&lt;b</a></li></ul>` },
+  } {
+    if toc := string(markdownTOC(tc.headings)); toc != tc.expect {
+      t.Errorf("%s:\n  %s\nexpected\n  %s", tc.name, toc, tc.expect)
+    }
+  }
+}
+
+
+func TestRenderMarkdown(t *testing.T) {
+  doc := renderMarkdown([]byte("# Intro\n\ntext\n\n## Intro\n\n## `code` *here*\n"))
+  var ids, titles []string
+  for _, h := range doc.headings {
+    ids = append(ids, h.ID)
+    titles = append(titles, h.Title)
+  }
+  if s := strings.Join(ids, " "); s != "intro intro-1 code-here" {
+    t.Errorf("ids %q", s)
+  }
+  if s := strings.Join(titles, "|"); s != "Intro|Intro|code here" {
+    t.Errorf("titles %q", s)
+  }
+  if doc.title != "Intro" {
+    t.Errorf("title %q, expected \"Intro\"", doc.title)
+  }
+  if !strings.Contains(string(doc.html), `<h2 id="intro-1">Intro</h2>`) {
+    t.Errorf("missing unique heading id in %s", doc.html)
+  }
+}
+
+
+func TestMarkdownLayout(t *testing.T) {
+  s, cleanup := newTestServer(t, map[string]string{
+    "_layout.ghp": "<main>{.Content}</main>",
+    "docs/a.md": "# Hello",
+  }, `
+pages:
+  enabled: true
+  markdown:
+    enabled: true
+`)
+  defer cleanup()
+
+  expectBody := func(prefix string) {
+    t.Helper()
+    w := testGet(s, "/docs/a.md", "")
+    expectStatus(t, w, "/docs/a.md", http.StatusOK)
+    if body := w.Body.String(); !strings.HasPrefix(body, prefix) {
+      t.Errorf("body %q, expected prefix %q", body, prefix)
+    }
+  }
+  expectBody("<main>")
+
+  // a layout closer to the page replaces the one it was built with
+  layout := filepath.Join(s.g.site.pubdir, "docs", "_layout.ghp")
+  if err := ioutil.WriteFile(layout, []byte("<article>{.Content}</article>"), 0600); err != nil {
+    t.Fatal(err)
+  }
+  expectBody("<article>")
+
+  // layouts are not served
+  for _, urlpath := range []string{ "/_layout.ghp", "/docs/_layout.ghp" } {
+    expectStatus(t, testGet(s, urlpath, ""), urlpath, http.StatusNotFound)
+  }
+}
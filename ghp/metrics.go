@@ -0,0 +1,367 @@
+package main
+
+import (
+  "bytes"
+  "io"
+  "math"
+  "net/http"
+  "regexp"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+
+  "github.com/rsms/ghp"
+)
+
+
+// metrics is the registry of all metrics of the process.
+// Metrics are always recorded, but only exposed when enabled in the config.
+//
+var metrics = newMetricsRegistry()
+
+// built-in metrics
+var (
+  httpRequests = metrics.Counter("ghp_http_requests_total",
+    "HTTP requests served, by server, status code and handler type.",
+    "server", "code", "handler")
+  httpRequestDuration = metrics.Histogram("ghp_http_request_duration_seconds",
+    "Time spent serving HTTP requests, by handler type.",
+    nil, "handler")
+  httpRequestsInFlight = metrics.Gauge("ghp_http_requests_in_flight",
+    "HTTP requests currently being served.")
+
+  pageBuilds = metrics.Counter("ghp_page_builds_total",
+    "Pages built.")
+  pageBuildErrors = metrics.Counter("ghp_page_build_errors_total",
+    "Pages which failed to build.")
+  pageBuildDuration = metrics.Histogram("ghp_page_build_duration_seconds",
+    "Time spent building pages.", nil)
+
+  servletBuilds = metrics.Counter("ghp_servlet_builds_total",
+    "Servlets compiled, by servlet.", "servlet")
+  servletBuildErrors = metrics.Counter("ghp_servlet_build_errors_total",
+    "Servlets which failed to build or load, by servlet.", "servlet")
+  servletBuildDuration = metrics.Histogram("ghp_servlet_build_duration_seconds",
+    "Time spent compiling servlets.",
+    []float64{.5, 1, 2.5, 5, 10, 20, 40, 80}, "servlet")
+  servletLoads = metrics.Counter("ghp_servlet_loads_total",
+    "Servlet instances loaded, by servlet.", "servlet")
+  servletReloads = metrics.Counter("ghp_servlet_reloads_total",
+    "Servlet instances replaced by a newer version, by servlet.", "servlet")
+
+  zdrHandovers = metrics.Counter("ghp_zdr_handovers_total",
+    "Zero-downtime restart handovers of listeners, by direction " +
+    "(\"received\" from an older process or \"released\" to a newer one).",
+    "direction")
+)
+
+
+// metricsRegistry implements ghp.Metrics
+//
+type metricsRegistry struct {
+  mu      sync.Mutex
+  metrics map[string]*metric
+}
+
+type metric struct {
+  name    string
+  help    string
+  typ     string  // "counter", "gauge" or "histogram"
+  labels  []string
+  buckets []float64  // upper bounds of histogram buckets
+
+  mu     sync.Mutex
+  series map[string]*metricSeries  // keyed by label values
+}
+
+type metricSeries struct {
+  labelValues []string
+  value       float64   // counter or gauge value
+  counts      []uint64  // histogram bucket counts (non-cumulative)
+  sum         float64   // sum of histogram observations
+  count       uint64    // number of histogram observations
+}
+
+var metricNameRe = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+
+func newMetricsRegistry() *metricsRegistry {
+  return &metricsRegistry{ metrics: make(map[string]*metric) }
+}
+
+
+func (m *metricsRegistry) Counter(name, help string, labels ...string) ghp.Counter {
+  return counterMetric{ m.register(name, help, "counter", nil, labels) }
+}
+
+func (m *metricsRegistry) Gauge(name, help string, labels ...string) ghp.Gauge {
+  return gaugeMetric{ m.register(name, help, "gauge", nil, labels) }
+}
+
+func (m *metricsRegistry) Histogram(name, help string, buckets []float64, labels ...string) ghp.Histogram {
+  if buckets == nil {
+    buckets = ghp.DefaultBuckets
+  }
+  if !sort.Float64sAreSorted(buckets) {
+    panic(errorf("buckets of metric %q are not in increasing order", name))
+  }
+  return histogramMetric{ m.register(name, help, "histogram", buckets, labels) }
+}
+
+
+// register returns the metric with name, creating it if needed
+//
+func (m *metricsRegistry) register(name, help, typ string, buckets []float64, labels []string) *metric {
+  if !metricNameRe.MatchString(name) {
+    panic(errorf("invalid metric name %q", name))
+  }
+  for _, label := range labels {
+    if !metricNameRe.MatchString(label) || strings.IndexByte(label, ':') != -1 {
+      panic(errorf("invalid label name %q of metric %q", label, name))
+    }
+  }
+
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  if x := m.metrics[name]; x != nil {
+    if x.typ != typ || strings.Join(x.labels, ",") != strings.Join(labels, ",") {
+      panic(errorf("metric %q already registered with a different type or labels", name))
+    }
+    return x
+  }
+
+  x := &metric{
+    name: name,
+    help: help,
+    typ: typ,
+    labels: labels,
+    buckets: buckets,
+    series: make(map[string]*metricSeries),
+  }
+  m.metrics[name] = x
+  return x
+}
+
+
+// getSeries returns the series for labelValues. x.mu must be locked.
+//
+func (x *metric) getSeries(labelValues []string) *metricSeries {
+  if len(labelValues) != len(x.labels) {
+    panic(errorf("metric %q takes %d label values, got %d",
+      x.name, len(x.labels), len(labelValues)))
+  }
+  key := strings.Join(labelValues, "\xff")
+  s := x.series[key]
+  if s == nil {
+    s = &metricSeries{ labelValues: append([]string{}, labelValues...) }
+    if x.buckets != nil {
+      s.counts = make([]uint64, len(x.buckets))
+    }
+    x.series[key] = s
+  }
+  return s
+}
+
+
+type counterMetric struct { *metric }
+
+func (c counterMetric) Inc(labelValues ...string) {
+  c.Add(1, labelValues...)
+}
+
+func (c counterMetric) Add(v float64, labelValues ...string) {
+  if v < 0 {
+    panic(errorf("counter %q can not decrease", c.name))
+  }
+  c.mu.Lock()
+  c.getSeries(labelValues).value += v
+  c.mu.Unlock()
+}
+
+
+type gaugeMetric struct { *metric }
+
+func (g gaugeMetric) Set(v float64, labelValues ...string) {
+  g.mu.Lock()
+  g.getSeries(labelValues).value = v
+  g.mu.Unlock()
+}
+
+func (g gaugeMetric) Add(v float64, labelValues ...string) {
+  g.mu.Lock()
+  g.getSeries(labelValues).value += v
+  g.mu.Unlock()
+}
+
+
+type histogramMetric struct { *metric }
+
+func (h histogramMetric) Observe(v float64, labelValues ...string) {
+  h.mu.Lock()
+  s := h.getSeries(labelValues)
+  if i := sort.SearchFloat64s(h.buckets, v); i < len(s.counts) {
+    s.counts[i]++
+  }
+  s.sum += v
+  s.count++
+  h.mu.Unlock()
+}
+
+
+// WriteTo writes all metrics in the Prometheus text exposition format.
+// Metrics are formatted in memory first, so that a slow w doesn't block
+// updates of metrics.
+//
+func (m *metricsRegistry) WriteTo(w io.Writer) (int64, error) {
+  m.mu.Lock()
+  names := make([]string, 0, len(m.metrics))
+  for name := range m.metrics {
+    names = append(names, name)
+  }
+  m.mu.Unlock()
+  sort.Strings(names)
+
+  var b bytes.Buffer
+  for _, name := range names {
+    m.mu.Lock()
+    x := m.metrics[name]
+    m.mu.Unlock()
+    x.write(&b)
+  }
+  return b.WriteTo(w)
+}
+
+
+func (x *metric) write(w *bytes.Buffer) {
+  x.mu.Lock()
+  defer x.mu.Unlock()
+
+  if x.help != "" {
+    w.WriteString("# HELP " + x.name + " " + escapeMetricHelp(x.help) + "\n")
+  }
+  w.WriteString("# TYPE " + x.name + " " + x.typ + "\n")
+
+  if len(x.labels) == 0 {
+    x.getSeries(nil)  // metrics without labels are always reported
+  }
+
+  keys := make([]string, 0, len(x.series))
+  for key := range x.series {
+    keys = append(keys, key)
+  }
+  sort.Strings(keys)
+
+  for _, key := range keys {
+    s := x.series[key]
+    labels := formatMetricLabels(x.labels, s.labelValues)
+    if x.typ != "histogram" {
+      w.WriteString(x.name + wrapMetricLabels(labels) + " " + formatMetricValue(s.value) + "\n")
+      continue
+    }
+    var cumulative uint64
+    for i, le := range x.buckets {
+      cumulative += s.counts[i]
+      w.WriteString(x.name + "_bucket" +
+        wrapMetricLabels(joinMetricLabels(labels, `le="` + formatMetricValue(le) + `"`)) +
+        " " + strconv.FormatUint(cumulative, 10) + "\n")
+    }
+    w.WriteString(x.name + "_bucket" + wrapMetricLabels(joinMetricLabels(labels, `le="+Inf"`)) +
+      " " + strconv.FormatUint(s.count, 10) + "\n")
+    w.WriteString(x.name + "_sum" + wrapMetricLabels(labels) + " " + formatMetricValue(s.sum) + "\n")
+    w.WriteString(x.name + "_count" + wrapMetricLabels(labels) + " " +
+      strconv.FormatUint(s.count, 10) + "\n")
+  }
+}
+
+
+func formatMetricLabels(names, values []string) string {
+  var b strings.Builder
+  for i, name := range names {
+    if i > 0 {
+      b.WriteByte(',')
+    }
+    b.WriteString(name)
+    b.WriteString(`="`)
+    b.WriteString(escapeMetricLabelValue(values[i]))
+    b.WriteByte('"')
+  }
+  return b.String()
+}
+
+func joinMetricLabels(a, b string) string {
+  if a == "" {
+    return b
+  }
+  return a + "," + b
+}
+
+func wrapMetricLabels(labels string) string {
+  if labels == "" {
+    return ""
+  }
+  return "{" + labels + "}"
+}
+
+func formatMetricValue(v float64) string {
+  switch {
+  case math.IsInf(v, 1):
+    return "+Inf"
+  case math.IsInf(v, -1):
+    return "-Inf"
+  case math.IsNaN(v):
+    return "NaN"
+  }
+  return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var metricHelpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeMetricHelp(s string) string { return metricHelpEscaper.Replace(s) }
+func escapeMetricLabelValue(s string) string { return metricLabelEscaper.Replace(s) }
+
+
+// ---------------------------------------------------------------------------
+
+// serveMetrics serves the metrics endpoint, if r is for it.
+// Servers dedicated to metrics (metrics.address) serve nothing else.
+// Returns true if the request was responded to.
+//
+func (s *HttpServer) serveMetrics(w *HttpResponse, r *http.Request) bool {
+  c := &s.g.config.Metrics
+  if !s.metricsOnly && (!c.Enabled || c.server != nil) {
+    return false
+  }
+  if r.URL.Path != c.Path {
+    if s.metricsOnly {
+      s.replyNotFound(w)
+      return true
+    }
+    return false
+  }
+  w.setHandler("metrics", "")
+  w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+  w.Header().Set("Cache-Control", "no-store")
+  if r.Method == "HEAD" {
+    w.WriteHeader(http.StatusOK)
+    return true
+  }
+  metrics.WriteTo(w)
+  return true
+}
+
+
+// observeRequest records metrics of a completed request which started at
+// time start
+//
+func (s *HttpServer) observeRequest(w *HttpResponse, start time.Time) {
+  handler := w.handlerType
+  if handler == "" {
+    handler = "none"  // e.g. redirect or error
+  }
+  httpRequests.Inc(s.displayAddr(), strconv.Itoa(w.Status()), handler)
+  httpRequestDuration.Observe(time.Since(start).Seconds(), handler)
+}
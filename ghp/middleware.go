@@ -0,0 +1,107 @@
+package main
+
+import (
+  "net/http"
+  "path/filepath"
+  "strings"
+
+  "github.com/rsms/ghp"
+)
+
+// middlewareFilename is the file which makes a pub-dir directory have
+// middleware, applied to all requests in the directory's subtree.
+// Middleware is built, loaded and hot-reloaded like servlets.
+//
+const middlewareFilename = "middleware.go"
+
+
+func NewMiddlewareCache(site *Site, c *ServletConfig, builddir string) *ServletCache {
+  cache := NewServletCache(site, c, builddir)
+  cache.middleware = true
+  return cache
+}
+
+
+// middlewareFor returns the middleware of fspath and its parent
+// directories in pub-dir, outermost (closest to pub-dir) first
+//
+func (s *Site) middlewareFor(fspath string) ([]*Servlet, error) {
+  if s.middlewareCache == nil {
+    return nil, nil
+  }
+  rel, err := filepath.Rel(s.pubdir, fspath)
+  if err != nil || rel == ".." || strings.HasPrefix(rel, ".." + string(filepath.Separator)) {
+    rel = "."
+  }
+
+  var chain []*Servlet
+  dir, name := s.pubdir, "."
+  for {
+    if checkIsFile(pjoin(dir, middlewareFilename)) == nil {
+      m, err := s.middlewareCache.Get(name)
+      if err != nil {
+        return nil, err
+      }
+      chain = append(chain, m)
+    }
+    if rel == "." {
+      return chain, nil
+    }
+    i := strings.IndexByte(rel, filepath.Separator)
+    if i == -1 {
+      dir = filepath.Join(dir, rel)
+      rel = "."
+    } else {
+      dir = filepath.Join(dir, rel[:i])
+      rel = rel[i+1:]
+    }
+    name = relfile(s.pubdir, dir)
+  }
+}
+
+
+// serveMiddleware serves r through the middleware in chain, outermost
+// first, with serve handling the request last
+//
+func (s *HttpServer) serveMiddleware(chain []*Servlet, w *HttpResponse, r *http.Request, serve func(*HttpResponse, *http.Request)) {
+  var next ghp.ServeHTTP = func(r *ghp.Request, rw ghp.Response) {
+    hr := (*http.Request)(r)
+    serve(w.passedOn(rw, hr), hr)
+  }
+  for i := len(chain) - 1; i >= 0; i-- {
+    next = chain[i].middleware(next)
+  }
+  w.setHandler("middleware", chain[len(chain)-1].name)
+  next((*ghp.Request)(r), w)
+}
+
+
+// passedOn returns the response to serve r with, given the response rw
+// which middleware passed on to the next handler. This is w itself, unless
+// the middleware wrapped it, e.g. to capture the status code.
+//
+func (w *HttpResponse) passedOn(rw ghp.Response, r *http.Request) *HttpResponse {
+  if hw, ok := rw.(*HttpResponse); ok {
+    hw.r = r
+    return hw
+  }
+  return &HttpResponse{
+    ResponseWriter: middlewareWriter{rw},
+    s: w.s,
+    r: r,
+    site: w.site,
+    outer: w,
+  }
+}
+
+
+// middlewareWriter adapts a ghp.Response from middleware to
+// http.ResponseWriter, http.Flusher and http.Hijacker
+//
+type middlewareWriter struct {
+  ghp.Response
+}
+
+func (w middlewareWriter) Flush() {
+  w.Response.Flush()
+}
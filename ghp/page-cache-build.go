@@ -65,7 +65,13 @@ func (c *PageCache) Build(bc *buildCtx, f *os.File, d os.FileInfo) (*Page, error
 
   // Build
   p := &Page{ cache: c }
+  start := time.Now()
   c.buildSafe(bc, p, f, d)
+  pageBuildDuration.Observe(time.Since(start).Seconds())
+  pageBuilds.Inc()
+  if p.builderr != nil {
+    pageBuildErrors.Inc()
+  }
 
   // Place result in items map (full write-lock)
   c.itemsmu.Lock()
@@ -139,7 +145,13 @@ func (c *PageCache) buildPage(bc *buildCtx, p *Page, f *os.File, d os.FileInfo)
   helpers := p.buildHelpers(c.helpers)
 
   // parse source
-  asts, meta, err := c.parsePage(name, source, helpers)
+  var asts map[string]*tparse.Tree
+  var meta *PageMetadata
+  if c.isMarkdown(f.Name()) {
+    p.md, meta, err = c.parseMarkdown(name, source)
+  } else {
+    asts, meta, err = c.parsePage(name, source, helpers)
+  }
   if err != nil {
     p.builderr = err
     return err
@@ -151,26 +163,46 @@ func (c *PageCache) buildPage(bc *buildCtx, p *Page, f *os.File, d os.FileInfo)
   p.mtime = mtime
   p.meta = meta
   p.relatedPageMissing = ""
+  p.layoutsMissing = nil
 
   // set fileid
   p.fileid = fileID(d)
 
-  // has parent?
-  if meta != nil && len(meta.Parent) > 0 {
-    pp, err := c.loadRelatedPage(bc, f.Name(), meta.Parent)
+  // has parent? Markdown pages default to the nearest layout file
+  parent := ""
+  if meta != nil {
+    parent = meta.Parent
+  }
+  if parent == "" && p.md != nil {
+    parent, p.layoutsMissing = c.findLayout(f.Name())
+  }
+  if len(parent) > 0 {
+    pp, err := c.loadRelatedPage(bc, f.Name(), parent)
+    if err == nil && pp.md != nil {
+      err = errorf("Markdown page %q can not be a parent", pp.name)
+    }
     if err != nil {
       if os.IsNotExist(err) {
-        err = errorf("parent not found %q", meta.Parent)
+        err = errorf("parent not found %q", parent)
       }
-      p.relatedPageMissing = meta.Parent
+      p.relatedPageMissing = parent
       p.builderr = err
       return err
     }
     p.parent = pp
   }
 
+  // Markdown pages without parent are wrapped in the default layout
+  if p.md != nil && p.parent == nil {
+    asts, err = tparse.Parse(p.name, markdownDefaultLayout, "{", "}", helpers)
+    if err != nil {
+      p.builderr = err
+      return err
+    }
+  }
+
   // html or text template?
-  if meta == nil ||
+  if meta == nil || p.md != nil ||
      meta.Type == "" ||
      strings.Index(meta.Type, "html") != -1 ||
      strings.Index(meta.Type, "xml") != -1 {
@@ -179,17 +211,21 @@ func (c *PageCache) buildPage(bc *buildCtx, p *Page, f *os.File, d os.FileInfo)
     p.t = NewTextTemplate(p.name)
   }
 
-  // add primary template
-  p.t, err = p.t.AddParseTree1(p.name, asts[p.name])
-  if err != nil {
-    p.builderr = err
-    return err
+  // add primary template. Markdown pages with a parent have none.
+  if ast := asts[p.name]; ast != nil {
+    p.t, err = p.t.AddParseTree1(p.name, ast)
+    if err != nil {
+      p.builderr = err
+      return err
+    }
   }
 
   // add parent 
   if p.parent != nil {
     for _, pt := range p.parent.t.Templates() {
-      logf("add branch template: %v", pt.Name())
+      if devMode {
+        logf("add branch template: %v", pt.Name())
+      }
       if err := p.t.AddParseTree(pt.Name(), pt.Tree()); err != nil {
         p.builderr = err
         return err
@@ -202,7 +238,9 @@ func (c *PageCache) buildPage(bc *buildCtx, p *Page, f *os.File, d os.FileInfo)
     // creates or replaces template with tname in t
     if tname != p.name {
       // Returns t if tname == t.Name(), else the named template is returned.
-      logf("add leaf template: %v", tname)
+      if devMode {
+        logf("add leaf template: %v", tname)
+      }
       if err := p.t.AddParseTree(tname, ast); err != nil {
         p.builderr = err
         return err
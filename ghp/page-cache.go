@@ -8,9 +8,11 @@ import (
 
 
 type PageCache struct {
-  g       *Ghp
+  site    *Site
   c       *PagesConfig
   fileext string
+  mdext   string  // file extension of Markdown pages. "" when disabled
+  layout  string  // file name of conventional layouts of Markdown pages
   srcdir  string
 
   items   map[string]*Page  // keyed by filename
@@ -23,7 +25,7 @@ type PageCache struct {
 }
 
 
-func NewPageCache(g *Ghp, config *PagesConfig) *PageCache {
+func NewPageCache(site *Site, config *PagesConfig) *PageCache {
   fileext := ".ghp"
   if config.FileExt != "" {
     // make sure it begins with a single "."
@@ -31,15 +33,26 @@ func NewPageCache(g *Ghp, config *PagesConfig) *PageCache {
   }
 
   c := &PageCache{
-    g: g,
+    site: site,
     c: config,
     fileext: fileext,
-    srcdir: g.config.PubDir,
+    srcdir: site.pubdir,
     items: make(map[string]*Page),
   }
 
+  if md := &config.Markdown; md.Enabled {
+    c.mdext = ".md"
+    if md.FileExt != "" {
+      c.mdext = "." + strings.TrimLeft(md.FileExt, ".")
+    }
+    c.layout = md.Layout
+    if c.layout == "" {
+      c.layout = "_layout" + fileext
+    }
+  }
+
   // build helper functions
-  c.helpers = c.buildHelpers(g.helperfuns)
+  c.helpers = c.buildHelpers(site.helperfuns)
 
   return c
 }
@@ -62,6 +75,32 @@ func (c *PageCache) Get(bc *buildCtx, f *os.File, d os.FileInfo) (*Page, error)
 }
 
 
+// Items returns a copy of the cache, keyed by source filename
+//
+func (c *PageCache) Items() map[string]*Page {
+  c.itemsmu.RLock()
+  defer c.itemsmu.RUnlock()
+  m := make(map[string]*Page, len(c.items))
+  for k, p := range c.items {
+    m[k] = p
+  }
+  return m
+}
+
+
+// Evict removes the page built from source filename from the cache.
+// The page is built again the next time it's requested.
+// Returns false if filename is not in the cache.
+//
+func (c *PageCache) Evict(filename string) bool {
+  c.itemsmu.Lock()
+  defer c.itemsmu.Unlock()
+  _, ok := c.items[filename]
+  delete(c.items, filename)
+  return ok
+}
+
+
 // GetCached unconditionally returns a page if one is found in cache.
 // Caller should check p.builderr
 //
@@ -72,13 +72,13 @@ func buildBaseHelpers() HelpersMap {
 }
 
 
-func (g *Ghp) buildHelpers(base HelpersMap) HelpersMap {
-  // helper functions shared by everything in the same Ghp instance.
+func (s *Site) buildHelpers(base HelpersMap) HelpersMap {
+  // helper functions shared by everything in the same site.
   h := NewHelpersMap(base)
 
-  // readfile reads a file relative to PubDir
+  // readfile reads a file relative to the site's pubdir
   h["readfile"] = func (name string) (string, error) {
-    fn := cleanFileName(g.config.PubDir, name)
+    fn := cleanFileName(s.pubdir, name)
     if fn == "" {
       return "", errorf("file not found %v", name)
     }
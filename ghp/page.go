@@ -17,9 +17,11 @@ type Page struct {
   fileid   uint64 // source file identifier e.g. inode
   builderr error  // non-nil when building failed
   relatedPageMissing string // non-empty when a related page is missing
+  layoutsMissing []string  // layout files looked for which didn't exist
   t        Template
   meta     *PageMetadata  // nil if there's no metadata
   parent   *Page          // nil when none
+  md       *markdownDoc   // non-nil for Markdown pages
 }
 
 
@@ -35,32 +37,88 @@ type pageData struct {
   URL       string
   Subtitle  string
   Meta      *PageMetadata
+  Params    map[string]string  // captures of matching route
+  User      string     // authenticated user of protected path
+  ClientIP  string     // IP address of client
   Content   template.HTML
+  Title     string             // title of Markdown page
+  Headings  []*markdownHeading // headings of Markdown page
+  TOC       template.HTML      // table of contents of Markdown page
+  Status    int        // HTTP status code, when rendering an error page
+  Error     *pageError // error details, in development mode
+}
+
+
+// pageError describes an error rendered by an error page
+//
+type pageError struct {
+  Message string
+  Details string  // e.g. go build output
+}
+
+
+func makePageError(message interface{}) *pageError {
+  if err, ok := message.(error); ok {
+    e := &pageError{ Message: err.Error() }
+    if be, ok := err.(*GoBuildError); ok {
+      e.Details = be.Details
+    }
+    return e
+  } else if s, ok := message.(string); ok {
+    return &pageError{ Message: s }
+  }
+  return nil
 }
 
 
 // Serve serves the page as response w for request r
 //
 func (p *Page) Serve(w http.ResponseWriter, r *http.Request) error {
+  p.setHeaders(w.Header())
+  return p.Render(w, r)
+}
+
+
+// setHeaders adds any headers defined by the page's metadata
+//
+func (p *Page) setHeaders(header http.Header) {
   if p.meta != nil && len(p.meta.Headers) > 0 {
-    header := w.Header()
     for name, value := range p.meta.Headers {
       header.Add(name, value)
     }
   }
-  return p.Render(w, r)
 }
 
 
 // Render outputs the page to w for request r
 //
 func (p *Page) Render(w io.Writer, r *http.Request) error {
+  return p.render(w, p.newPageData(r))
+}
+
+
+func (p *Page) newPageData(r *http.Request) *pageData {
   d := &pageData{
     URL: r.URL.Path,
     Subtitle: "subtitle here",
     Meta: p.meta,
   }
-  if p.parent != nil {
+  if p.md != nil {
+    d.Title = p.md.title
+    d.Headings = p.md.headings
+    d.TOC = p.md.toc
+  }
+  if st := requestState(r); st != nil {
+    d.Params = st.Params
+    d.User = st.User
+    d.ClientIP = st.ClientIP
+  }
+  return d
+}
+
+
+func (p *Page) render(w io.Writer, d *pageData) error {
+  if p.parent != nil || p.md != nil {
     return p.renderWithParent(w, d)
   } else {
     return p.t.Exec(w, d)
@@ -90,6 +148,14 @@ func (p *Page) renderWithParent(w io.Writer, d *pageData) error {
 
   page := p
 
+  // A Markdown page is rendered by its parent, or the default layout
+  if p.md != nil {
+    content = string(p.md.html)
+    if p.parent != nil {
+      page = p.parent
+    }
+  }
+
   for page.parent != nil {
     d.Content = template.HTML(content)
     content, err = p.renderTemplateString(page.name, d)
@@ -145,9 +211,16 @@ func (p *Page) olderThanSource(d os.FileInfo) bool {
     return true
   }
 
+  // a layout has been added closer to a Markdown page than its layout
+  for _, filename := range p.layoutsMissing {
+    if _, err := os.Stat(filename); err == nil {
+      return true
+    }
+  }
+
   // check parent
   if p.parent != nil {
-    d, err := os.Stat(p.srcpath)
+    d, err := os.Stat(p.parent.srcpath)
     return err != nil || p.parent.olderThanSource(d)
   }
 
@@ -0,0 +1,236 @@
+package main
+
+import (
+  "bufio"
+  "bytes"
+  "encoding/binary"
+  "io"
+  "net"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+// proxyProtocolTimeout is the max time for a client to send a PROXY header
+const proxyProtocolTimeout = 10 * time.Second
+
+// signature of PROXY protocol version 2 headers
+var proxyProtocolV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+
+// proxyProtocolListener accepts connections which start with a PROXY
+// protocol (version 1 or 2) header, sent by a load balancer like HAProxy
+// to pass on the address of the client. The remote address of accepted
+// connections is that of the client.
+// Connections without a valid header are closed, as are connections from
+// peers which are not trusted, when trusted is not nil.
+//
+// Headers are read in the background so that slow clients don't hold up
+// accepting other connections.
+//
+type proxyProtocolListener struct {
+  net.Listener
+  trusted   *TrustedProxies  // peers allowed to connect. nil for any
+  conns     chan net.Conn
+  errc      chan error
+  done      chan struct{}
+  startOnce sync.Once
+  closeOnce sync.Once
+}
+
+
+func newProxyProtocolListener(l net.Listener, trusted *TrustedProxies) *proxyProtocolListener {
+  return &proxyProtocolListener{
+    Listener: l,
+    trusted: trusted,
+    conns: make(chan net.Conn),
+    errc: make(chan error),
+    done: make(chan struct{}),
+  }
+}
+
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+  l.startOnce.Do(func() { go l.acceptLoop() })
+  select {
+  case c := <-l.conns:
+    return c, nil
+  case err := <-l.errc:
+    return nil, err
+  case <-l.done:
+    return nil, errorf("listener closed")
+  }
+}
+
+
+func (l *proxyProtocolListener) Close() error {
+  l.closeOnce.Do(func() { close(l.done) })
+  return l.Listener.Close()
+}
+
+
+func (l *proxyProtocolListener) acceptLoop() {
+  for {
+    c, err := l.Listener.Accept()
+    if err != nil {
+      select {
+      case l.errc <- err:
+      case <-l.done:
+        return
+      }
+      if ne, ok := err.(net.Error); ok && ne.Temporary() {
+        continue
+      }
+      return
+    }
+    go l.handshake(c)
+  }
+}
+
+
+func (l *proxyProtocolListener) handshake(c net.Conn) {
+  if l.trusted != nil {
+    host, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+    if !l.trusted.Contains(host) {
+      logf("[proxy-protocol] %s: not a trusted proxy", c.RemoteAddr())
+      c.Close()
+      return
+    }
+  }
+  c.SetReadDeadline(time.Now().Add(proxyProtocolTimeout))
+  br := bufio.NewReader(c)
+  raddr, err := readProxyHeader(br)
+  if err != nil {
+    logf("[proxy-protocol] %s: %v", c.RemoteAddr(), err)
+    c.Close()
+    return
+  }
+  c.SetReadDeadline(time.Time{})
+
+  pc := &proxyProtocolConn{ Conn: c, r: br, raddr: raddr }
+  if pc.raddr == nil {
+    pc.raddr = c.RemoteAddr()  // e.g. health check from the load balancer
+  }
+  select {
+  case l.conns <- pc:
+  case <-l.done:
+    c.Close()
+  }
+}
+
+
+// proxyProtocolConn is a connection with the client address from a PROXY
+// protocol header
+//
+type proxyProtocolConn struct {
+  net.Conn
+  r     *bufio.Reader  // holds data read past the header
+  raddr net.Addr
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+  return c.r.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+  return c.raddr
+}
+
+
+// readProxyHeader reads a PROXY protocol header from r and returns the
+// source address. Returns a nil address for headers which carry no address
+// ("UNKNOWN" in version 1 and LOCAL in version 2).
+//
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+  sig, err := r.Peek(len(proxyProtocolV2Sig))
+  if err != nil && len(sig) < 6 {
+    return nil, errorf("missing PROXY header: %v", err)
+  }
+  if bytes.Equal(sig, proxyProtocolV2Sig) {
+    return readProxyHeaderV2(r)
+  }
+  if bytes.HasPrefix(sig, []byte("PROXY ")) {
+    return readProxyHeaderV1(r)
+  }
+  return nil, errorf("missing PROXY header")
+}
+
+
+// readProxyHeaderV1 reads a header like
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+//
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+  var line []byte
+  for len(line) < 107 {  // max length of a v1 header
+    b, err := r.ReadByte()
+    if err != nil {
+      return nil, err
+    }
+    line = append(line, b)
+    if b == '\n' {
+      break
+    }
+  }
+  if !bytes.HasSuffix(line, []byte("\r\n")) {
+    return nil, errorf("malformed PROXY v1 header")
+  }
+  fields := strings.Split(string(line[:len(line)-2]), " ")
+  if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+    return nil, nil
+  }
+  if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+    return nil, errorf("malformed PROXY v1 header %q", line)
+  }
+  ip := net.ParseIP(fields[2])
+  port, err := strconv.ParseUint(fields[4], 10, 16)
+  if ip == nil || err != nil {
+    return nil, errorf("malformed PROXY v1 header %q", line)
+  }
+  return &net.TCPAddr{ IP: ip, Port: int(port) }, nil
+}
+
+
+// readProxyHeaderV2 reads a binary header
+//
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+  var hdr [16]byte
+  if _, err := io.ReadFull(r, hdr[:]); err != nil {
+    return nil, err
+  }
+  if hdr[12] >> 4 != 2 {
+    return nil, errorf("unsupported PROXY protocol version %d", hdr[12] >> 4)
+  }
+  cmd := hdr[12] & 0xf
+  family := hdr[13] >> 4
+  body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+  if _, err := io.ReadFull(r, body); err != nil {
+    return nil, err
+  }
+
+  if cmd == 0 {
+    return nil, nil  // LOCAL, e.g. health check from the load balancer
+  }
+  if cmd != 1 {
+    return nil, errorf("unsupported PROXY v2 command %d", cmd)
+  }
+  switch family {
+  case 1:  // AF_INET
+    if len(body) < 12 {
+      return nil, errorf("short PROXY v2 header")
+    }
+    return &net.TCPAddr{
+      IP: net.IP(append([]byte{}, body[0:4]...)),
+      Port: int(binary.BigEndian.Uint16(body[8:10])),
+    }, nil
+  case 2:  // AF_INET6
+    if len(body) < 36 {
+      return nil, errorf("short PROXY v2 header")
+    }
+    return &net.TCPAddr{
+      IP: net.IP(append([]byte{}, body[0:16]...)),
+      Port: int(binary.BigEndian.Uint16(body[32:34])),
+    }, nil
+  }
+  return nil, nil  // AF_UNSPEC or AF_UNIX; no usable address
+}
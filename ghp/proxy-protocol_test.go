@@ -0,0 +1,153 @@
+package main
+
+import (
+  "bufio"
+  "encoding/binary"
+  "io/ioutil"
+  "net"
+  "strings"
+  "testing"
+  "time"
+)
+
+
+// proxyHeaderV2 returns a version 2 header with command cmd (0 LOCAL,
+// 1 PROXY), address family fam (1 AF_INET, 2 AF_INET6) and body
+//
+func proxyHeaderV2(ver, cmd, fam byte, body []byte) string {
+  hdr := append([]byte{}, proxyProtocolV2Sig...)
+  hdr = append(hdr, ver << 4 | cmd, fam << 4 | 1, 0, 0)
+  binary.BigEndian.PutUint16(hdr[14:16], uint16(len(body)))
+  return string(append(hdr, body...))
+}
+
+
+// proxyAddrsV2 returns the address block of a version 2 header
+//
+func proxyAddrsV2(src, dst string, sport, dport uint16) []byte {
+  srcip, dstip := net.ParseIP(src), net.ParseIP(dst)
+  if ip4 := srcip.To4(); ip4 != nil {
+    srcip, dstip = ip4, dstip.To4()
+  }
+  b := append(append([]byte{}, srcip...), dstip...)
+  var ports [4]byte
+  binary.BigEndian.PutUint16(ports[0:2], sport)
+  binary.BigEndian.PutUint16(ports[2:4], dport)
+  return append(b, ports[:]...)
+}
+
+
+func TestReadProxyHeader(t *testing.T) {
+  inet := proxyAddrsV2("192.0.2.1", "198.51.100.1", 56324, 443)
+  inet6 := proxyAddrsV2("2001:db8::1", "2001:db8::2", 443, 80)
+  tlv := append(append([]byte{}, inet...), 0x04, 0, 1, 'x')  // PP2_TYPE_NOOP
+
+  for _, tc := range []struct {
+    name   string
+    input  string
+    addr   string  // "" for no address
+    err    bool
+  }{
+    { "v1 tcp4", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", "192.0.2.1:56324", false },
+    { "v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 443 80\r\n", "[2001:db8::1]:443", false },
+    { "v1 unknown", "PROXY UNKNOWN\r\n", "", false },
+    { "v1 unknown with addresses", "PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n", "", false },
+    { "v1 missing port", "PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n", "", true },
+    { "v1 bad ip", "PROXY TCP4 x 198.51.100.1 1 2\r\n", "", true },
+    { "v1 bad port", "PROXY TCP4 192.0.2.1 198.51.100.1 70000 443\r\n", "", true },
+    { "v1 bad protocol", "PROXY UDP4 192.0.2.1 198.51.100.1 1 2\r\n", "", true },
+    { "v1 no CR", "PROXY TCP4 192.0.2.1 198.51.100.1 1 2\n", "", true },
+    { "v1 too long", "PROXY " + strings.Repeat("x", 120) + "\r\n", "", true },
+    { "v1 truncated", "PROXY TCP4 192.0.2.1", "", true },
+    { "v2 inet", proxyHeaderV2(2, 1, 1, inet), "192.0.2.1:56324", false },
+    { "v2 inet6", proxyHeaderV2(2, 1, 2, inet6), "[2001:db8::1]:443", false },
+    { "v2 with TLV", proxyHeaderV2(2, 1, 1, tlv), "192.0.2.1:56324", false },
+    { "v2 local", proxyHeaderV2(2, 0, 0, nil), "", false },
+    { "v2 local with address", proxyHeaderV2(2, 0, 1, inet), "", false },
+    { "v2 unspec", proxyHeaderV2(2, 1, 0, nil), "", false },
+    { "v2 version 1", proxyHeaderV2(1, 1, 1, inet), "", true },
+    { "v2 bad command", proxyHeaderV2(2, 2, 1, inet), "", true },
+    { "v2 short inet", proxyHeaderV2(2, 1, 1, inet[:4]), "", true },
+    { "v2 short inet6", proxyHeaderV2(2, 1, 2, inet), "", true },
+    { "v2 truncated", proxyHeaderV2(2, 1, 1, inet)[:20], "", true },
+    { "http", "GET / HTTP/1.1\r\n", "", true },
+    { "short", "PRO", "", true },
+    { "empty", "", "", true },
+  } {
+    r := bufio.NewReader(strings.NewReader(tc.input + "GET /"))
+    addr, err := readProxyHeader(r)
+    if tc.err {
+      if err == nil {
+        t.Errorf("%s: expected error, got address %v", tc.name, addr)
+      }
+      continue
+    }
+    if err != nil {
+      t.Errorf("%s: %v", tc.name, err)
+      continue
+    }
+    s := ""
+    if addr != nil {
+      s = addr.String()
+    }
+    if s != tc.addr {
+      t.Errorf("%s: address %q, expected %q", tc.name, s, tc.addr)
+    }
+    // the whole header, and nothing more, is consumed
+    if rest, _ := ioutil.ReadAll(r); string(rest) != "GET /" {
+      t.Errorf("%s: remaining data %q, expected \"GET /\"", tc.name, rest)
+    }
+  }
+}
+
+
+func TestProxyProtocolListenerTrusted(t *testing.T) {
+  for _, tc := range []struct {
+    trusted []string
+    ok      bool
+  }{
+    { nil, true },
+    { []string{"127.0.0.1"}, true },
+    { []string{"10.0.0.0/8"}, false },
+  } {
+    var trusted *TrustedProxies
+    if tc.trusted != nil {
+      var err error
+      if trusted, err = ParseTrustedProxies(tc.trusted); err != nil {
+        t.Fatal(err)
+      }
+    }
+    tcpln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+      t.Fatal(err)
+    }
+    ln := newProxyProtocolListener(tcpln, trusted)
+
+    c, err := net.Dial("tcp", tcpln.Addr().String())
+    if err != nil {
+      t.Fatal(err)
+    }
+    c.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 1234 80\r\nGET / HTTP/1.0\r\n\r\n"))
+
+    if tc.ok {
+      sc, err := ln.Accept()
+      if err != nil {
+        t.Fatal(err)
+      }
+      if addr := sc.RemoteAddr().String(); addr != "192.0.2.1:1234" {
+        t.Errorf("trusted %v: remote address %q, expected \"192.0.2.1:1234\"", tc.trusted, addr)
+      }
+      sc.Close()
+    } else {
+      // the connection is closed without being accepted
+      go ln.Accept()
+      c.SetReadDeadline(time.Now().Add(5 * time.Second))
+      _, err := c.Read(make([]byte, 1))
+      if ne, ok := err.(net.Error); err == nil || ok && ne.Timeout() {
+        t.Errorf("trusted %v: read %v, expected connection to be closed", tc.trusted, err)
+      }
+    }
+    c.Close()
+    ln.Close()
+  }
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+  "bufio"
+  "context"
+  "crypto/tls"
+  "io"
+  "net"
+  "net/http"
+  "net/http/httputil"
+  "net/url"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+
+// ReverseProxy forwards requests matching a route to an upstream server,
+// over TCP or a unix socket.
+//
+type ReverseProxy struct {
+  s         *HttpServer
+  c         *RouteConfig
+  target    *url.URL  // scheme, host and base path of upstream
+  sockpath  string    // unix socket path. "" for TCP upstreams
+  dialer    *net.Dialer
+  transport *http.Transport
+  rp        *httputil.ReverseProxy
+  healthy   int32     // 1 when upstream is healthy. Accessed atomically
+  stopch    chan struct{}
+  stopOnce  sync.Once
+}
+
+
+// parseProxyTarget parses the proxy target of a route, which is either
+// a http or https URL, or "unix:path" for a unix socket.
+// Returns the upstream URL and, for unix sockets, the socket path.
+//
+func parseProxyTarget(target string) (*url.URL, string, error) {
+  if strings.HasPrefix(target, "unix:") {
+    sockpath := target[len("unix:"):]
+    if sockpath == "" {
+      return nil, "", errorf("missing socket path")
+    }
+    return &url.URL{ Scheme: "http", Host: "unix" }, sockpath, nil
+  }
+  u, err := url.Parse(target)
+  if err != nil {
+    return nil, "", err
+  }
+  if u.Scheme != "http" && u.Scheme != "https" {
+    return nil, "", errorf("scheme must be http, https or unix")
+  }
+  if u.Host == "" {
+    return nil, "", errorf("missing host")
+  }
+  return u, "", nil
+}
+
+
+func NewReverseProxy(s *HttpServer, c *RouteConfig) *ReverseProxy {
+  target, sockpath, _ := parseProxyTarget(c.Proxy)  // validated by onLoad
+  p := &ReverseProxy{
+    s: s,
+    c: c,
+    target: target,
+    sockpath: sockpath,
+    healthy: 1,
+    stopch: make(chan struct{}),
+    dialer: &net.Dialer{
+      Timeout:   10 * time.Second,
+      KeepAlive: 30 * time.Second,
+    },
+  }
+
+  p.transport = &http.Transport{
+    DialContext:           p.dialContext,
+    MaxIdleConnsPerHost:   32,
+    IdleConnTimeout:       90 * time.Second,
+    TLSHandshakeTimeout:   10 * time.Second,
+    ExpectContinueTimeout: 1 * time.Second,
+  }
+
+  p.rp = &httputil.ReverseProxy{
+    Director:      p.direct,
+    Transport:     p.transport,
+    FlushInterval: 100 * time.Millisecond,  // stream responses
+    ErrorLog:      logger,
+    ErrorHandler:  p.handleError,
+  }
+
+  return p
+}
+
+
+func (p *ReverseProxy) String() string {
+  return "ReverseProxy(" + p.c.Match + " -> " + p.c.Proxy + ")"
+}
+
+
+// Start starts health checks, if configured
+//
+func (p *ReverseProxy) Start() {
+  if p.c.HealthCheck != nil {
+    go p.healthLoop()
+  }
+}
+
+
+// Close stops health checks and closes idle upstream connections.
+// Requests in flight are not affected.
+//
+func (p *ReverseProxy) Close() {
+  p.stopOnce.Do(func() { close(p.stopch) })
+  p.transport.CloseIdleConnections()
+}
+
+
+func (p *ReverseProxy) ServeHTTP(w *HttpResponse, r *http.Request) {
+  w.setHandler("proxy", p.c.Proxy)
+
+  if atomic.LoadInt32(&p.healthy) == 0 {
+    p.s.replyStatus(w, http.StatusServiceUnavailable,
+      "upstream " + p.c.Proxy + " is unhealthy")
+    return
+  }
+
+  if headerHasToken(r.Header, "Connection", "upgrade") {
+    // e.g. WebSocket
+    p.serveUpgrade(w, r)
+    return
+  }
+
+  // X-Forwarded-For is set by direct. Without RemoteAddr,
+  // httputil.ReverseProxy doesn't append the peer's address to it.
+  outreq := r.WithContext(r.Context())
+  outreq.RemoteAddr = ""
+  p.rp.ServeHTTP(proxyResponse{w}, outreq)
+}
+
+
+// proxyResponse adapts HttpResponse to http.Flusher, which is used by
+// httputil.ReverseProxy to stream responses.
+//
+type proxyResponse struct {
+  *HttpResponse
+}
+
+func (w proxyResponse) Flush() {
+  w.HttpResponse.Flush()
+}
+
+
+// direct rewrites r to be sent to the upstream.
+// The request path is cleaned, so that ".." can't climb above the path of
+// the upstream URL.
+//
+func (p *ReverseProxy) direct(r *http.Request) {
+  path := p.target.Path
+  if strings.IndexByte(path, '{') != -1 {
+    var params map[string]string
+    if st := requestState(r); st != nil {
+      params = st.Params
+    }
+    path = expandRouteTarget(path, params)
+  } else if path != "" {
+    path = strings.TrimSuffix(path, "/") + cleanURLPath(r.URL.Path)
+  } else {
+    path = cleanURLPath(r.URL.Path)
+  }
+
+  r.URL.Scheme = p.target.Scheme
+  r.URL.Host = p.target.Host
+  r.URL.Path = path
+  r.URL.RawPath = ""
+  if q := p.target.RawQuery; q != "" {
+    if r.URL.RawQuery != "" {
+      r.URL.RawQuery = q + "&" + r.URL.RawQuery
+    } else {
+      r.URL.RawQuery = q
+    }
+  }
+
+  // the client address, resolved from the PROXY protocol or the
+  // X-Forwarded-For header of a trusted proxy
+  if ip := clientIP(r); ip != "" {
+    r.Header.Set("X-Forwarded-For", ip)
+  } else {
+    r.Header.Del("X-Forwarded-For")
+  }
+  proto := "http"
+  if r.TLS != nil {
+    proto = "https"
+  }
+  r.Header.Set("X-Forwarded-Host", r.Host)
+  r.Header.Set("X-Forwarded-Proto", proto)
+
+  if p.sockpath == "" {
+    r.Host = p.target.Host
+  }
+
+  if _, ok := r.Header["User-Agent"]; !ok {
+    // keep net/http from setting a default User-Agent
+    r.Header.Set("User-Agent", "")
+  }
+}
+
+
+func (p *ReverseProxy) handleError(w http.ResponseWriter, r *http.Request, err error) {
+  hw := w.(proxyResponse).HttpResponse
+  if r.Context().Err() != nil {
+    // client went away
+    hw.WriteHeader(http.StatusBadGateway)
+    return
+  }
+  p.s.replyStatus(hw, http.StatusBadGateway, err)
+}
+
+
+func (p *ReverseProxy) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+  if p.sockpath != "" {
+    return p.dialer.DialContext(ctx, "unix", p.sockpath)
+  }
+  return p.dialer.DialContext(ctx, network, addr)
+}
+
+
+// dialUpstream opens a connection to the upstream, with TLS for https
+//
+func (p *ReverseProxy) dialUpstream(ctx context.Context) (net.Conn, error) {
+  addr := p.target.Host
+  if p.target.Port() == "" {
+    if p.target.Scheme == "https" {
+      addr += ":443"
+    } else {
+      addr += ":80"
+    }
+  }
+  conn, err := p.dialContext(ctx, "tcp", addr)
+  if err != nil {
+    return nil, err
+  }
+  if p.target.Scheme == "https" {
+    tc := tls.Client(conn, &tls.Config{ ServerName: p.target.Hostname() })
+    if err := tc.Handshake(); err != nil {
+      conn.Close()
+      return nil, err
+    }
+    conn = tc
+  }
+  return conn, nil
+}
+
+
+// serveUpgrade forwards a request for a protocol upgrade, like WebSocket.
+// If the upstream switches protocols, data is copied in both directions
+// until either side closes the connection.
+//
+func (p *ReverseProxy) serveUpgrade(w *HttpResponse, r *http.Request) {
+  outreq := r.WithContext(r.Context())
+  outreq.Header = make(http.Header, len(r.Header))
+  for k, v := range r.Header {
+    outreq.Header[k] = v
+  }
+  u := *r.URL
+  outreq.URL = &u
+  p.direct(outreq)
+
+  upstream, err := p.dialUpstream(r.Context())
+  if err != nil {
+    p.s.replyStatus(w, http.StatusBadGateway, err)
+    return
+  }
+  if err := outreq.Write(upstream); err != nil {
+    upstream.Close()
+    p.s.replyStatus(w, http.StatusBadGateway, err)
+    return
+  }
+  ubr := bufio.NewReader(upstream)
+  res, err := http.ReadResponse(ubr, outreq)
+  if err != nil {
+    upstream.Close()
+    p.s.replyStatus(w, http.StatusBadGateway, err)
+    return
+  }
+
+  if res.StatusCode != http.StatusSwitchingProtocols {
+    // upstream declined the upgrade
+    defer upstream.Close()
+    defer res.Body.Close()
+    header := w.Header()
+    for k, v := range res.Header {
+      header[k] = v
+    }
+    w.WriteHeader(res.StatusCode)
+    io.Copy(w, res.Body)
+    return
+  }
+
+  conn, rw, err := w.Hijack()
+  if err != nil {
+    upstream.Close()
+    p.s.replyError(w, err)
+    return
+  }
+  defer conn.Close()
+  defer upstream.Close()
+
+  rw.WriteString("HTTP/1.1 " + res.Status + "\r\n")
+  res.Header.Write(rw)
+  rw.WriteString("\r\n")
+  if err := rw.Flush(); err != nil {
+    return
+  }
+
+  errc := make(chan error, 2)
+  go func() {
+    _, err := io.Copy(upstream, rw.Reader)
+    errc <- err
+  }()
+  go func() {
+    _, err := io.Copy(conn, ubr)
+    errc <- err
+  }()
+  <-errc  // return (and close both connections) when either side is done
+}
+
+
+// headerHasToken returns true if the comma-separated header name contains
+// token, compared case-insensitively.
+//
+func headerHasToken(h http.Header, name, token string) bool {
+  for _, v := range h[name] {
+    for _, t := range strings.Split(v, ",") {
+      if strings.EqualFold(strings.TrimSpace(t), token) {
+        return true
+      }
+    }
+  }
+  return false
+}
+
+
+func (p *ReverseProxy) healthLoop() {
+  hc := p.c.HealthCheck
+  client := &http.Client{
+    Transport: p.transport,
+    Timeout: hc.Timeout,
+  }
+  u := *p.target
+  u.Path = hc.Path
+  u.RawQuery = ""
+  checkURL := u.String()
+
+  ticker := time.NewTicker(hc.Interval)
+  defer ticker.Stop()
+  for {
+    p.checkHealth(client, checkURL)
+    select {
+    case <-p.stopch:
+      return
+    case <-ticker.C:
+    }
+  }
+}
+
+
+func (p *ReverseProxy) checkHealth(client *http.Client, checkURL string) {
+  healthy := int32(0)
+  res, err := client.Get(checkURL)
+  if err == nil {
+    res.Body.Close()
+    if res.StatusCode < 500 {
+      healthy = 1
+    } else {
+      err = errorf("status %d", res.StatusCode)
+    }
+  }
+  if atomic.SwapInt32(&p.healthy, healthy) != healthy {
+    if healthy == 1 {
+      logf("[proxy] upstream %s is healthy", p.c.Proxy)
+    } else {
+      logf("[proxy] upstream %s is unhealthy: %v", p.c.Proxy, err)
+    }
+  }
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+  "context"
+  "net/http/httptest"
+  "testing"
+
+  "github.com/rsms/ghp"
+)
+
+
+func TestReverseProxyDirect(t *testing.T) {
+  for _, tc := range []struct {
+    proxy   string
+    urlpath string
+    expect  string
+  }{
+    { "http://up", "/api/users", "/api/users" },
+    { "http://up/v1", "/api/users", "/v1/api/users" },
+    { "http://up/v1/", "/api/users", "/v1/api/users" },
+    { "http://up/api", "/api/users", "/api/api/users" },
+    { "http://up/{path}", "/api/users", "/users" },
+    { "http://up/base", "/api/../../x", "/base/x" },
+    { "http://up/base/", "/api/../..", "/base/" },
+    { "http://up/base", "/api//users/./", "/base/api/users/" },
+    { "http://up", "/api/../../x", "/x" },
+  } {
+    p := NewReverseProxy(nil, &RouteConfig{ Match: "/api/{path...}", Proxy: tc.proxy })
+    r := httptest.NewRequest("GET", tc.urlpath, nil)
+    r.Header.Set("X-Forwarded-For", "10.9.9.9")
+    if tc.proxy == "http://up/{path}" {
+      st := &ghp.RequestState{ Params: map[string]string{ "path": "users" } }
+      r = r.WithContext(context.WithValue(r.Context(), ghp.RequestStateKey, st))
+    }
+    p.direct(r)
+    if r.URL.Path != tc.expect {
+      t.Errorf("%s %s: path %q, expected %q", tc.proxy, tc.urlpath, r.URL.Path, tc.expect)
+    }
+    if r.URL.Host != "up" {
+      t.Errorf("%s: host %q, expected \"up\"", tc.proxy, r.URL.Host)
+    }
+    // the header from an untrusted client is replaced
+    if xff := r.Header.Get("X-Forwarded-For"); xff != "192.0.2.1" {
+      t.Errorf("%s: X-Forwarded-For %q, expected \"192.0.2.1\"", tc.proxy, xff)
+    }
+  }
+}
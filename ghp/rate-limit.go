@@ -0,0 +1,177 @@
+package main
+
+import (
+  "container/list"
+  "math"
+  "net/http"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+
+// RateLimiter limits the request rate of clients using token buckets.
+// Each client has a bucket holding up to burst tokens, which refills at
+// rate tokens per second. A request takes one token and is rejected when
+// the bucket is empty.
+//
+// Buckets of idle clients are dropped once they have refilled, and the
+// number of buckets is bounded by max-clients by dropping the bucket of the
+// least recently seen client.
+//
+type RateLimiter struct {
+  c       *RateLimitConfig
+  trusted *TrustedProxies  // peers whose key header is used. May be nil
+  mu      sync.Mutex
+  clients map[string]*list.Element  // bucket elements of lru, keyed by client
+  lru     *list.List  // *tokenBucket, most recently seen client first
+  swept   time.Time   // time of last sweep of idle clients
+}
+
+type tokenBucket struct {
+  key    string
+  tokens float64
+  last   time.Time  // time tokens was last updated
+}
+
+
+func NewRateLimiter(c *RateLimitConfig, trusted *TrustedProxies) *RateLimiter {
+  return &RateLimiter{
+    c: c,
+    trusted: trusted,
+    clients: make(map[string]*list.Element),
+    lru: list.New(),
+    swept: time.Now(),
+  }
+}
+
+
+// Allow takes a token from the bucket of client key.
+// If the bucket is empty, false is returned together with the time until
+// a token is available.
+//
+func (l *RateLimiter) Allow(key string, now time.Time) (bool, time.Duration) {
+  burst := float64(l.c.Burst)
+
+  l.mu.Lock()
+  defer l.mu.Unlock()
+
+  if now.Sub(l.swept) >= l.fillTime() {
+    l.sweep(now)
+  }
+
+  var b *tokenBucket
+  if e := l.clients[key]; e == nil {
+    if len(l.clients) >= l.c.MaxClients {
+      l.evictOldest()
+    }
+    b = &tokenBucket{ key: key, tokens: burst, last: now }
+    l.clients[key] = l.lru.PushFront(b)
+  } else {
+    b = e.Value.(*tokenBucket)
+    l.lru.MoveToFront(e)
+    if elapsed := now.Sub(b.last); elapsed > 0 {
+      b.tokens = math.Min(burst, b.tokens + elapsed.Seconds() * l.c.Rate)
+      b.last = now
+    }
+  }
+
+  if b.tokens < 1 {
+    wait := time.Duration((1 - b.tokens) / l.c.Rate * float64(time.Second))
+    return false, wait
+  }
+  b.tokens--
+  return true, 0
+}
+
+
+// fillTime returns the time it takes for an empty bucket to refill
+//
+func (l *RateLimiter) fillTime() time.Duration {
+  return time.Duration(float64(l.c.Burst) / l.c.Rate * float64(time.Second))
+}
+
+
+// sweep drops buckets of clients which have been idle long enough for their
+// buckets to be full, as they are equivalent to new buckets. Idle clients
+// are at the back of l.lru, so only dropped buckets are visited.
+// l.mu must be locked.
+//
+func (l *RateLimiter) sweep(now time.Time) {
+  fill := l.fillTime()
+  for e := l.lru.Back(); e != nil && now.Sub(e.Value.(*tokenBucket).last) >= fill; e = l.lru.Back() {
+    l.remove(e)
+  }
+  l.swept = now
+}
+
+
+// evictOldest drops the bucket of the client which was least recently seen.
+// l.mu must be locked.
+//
+func (l *RateLimiter) evictOldest() {
+  if e := l.lru.Back(); e != nil {
+    l.remove(e)
+  }
+}
+
+
+func (l *RateLimiter) remove(e *list.Element) {
+  delete(l.clients, l.lru.Remove(e).(*tokenBucket).key)
+}
+
+
+// clientKey returns the key identifying the client of r, which is the value
+// of the configured header or the client's IP address.
+// The header is only used when set by a trusted proxy, as clients could
+// otherwise get a new bucket for each request by varying its value.
+//
+func (l *RateLimiter) clientKey(r *http.Request) string {
+  if l.c.header != "" && l.trusted != nil && l.trusted.Contains(remoteHost(r)) {
+    if v := r.Header.Get(l.c.header); v != "" {
+      return "h:" + v
+    }
+  }
+  return clientIP(r)
+}
+
+// ---------------------------------------------------------------------------
+
+// rateLimit applies the first rate limit of the server matching urlpath,
+// responding with "429 Too Many Requests" when the client has exceeded it.
+// urlpath must be clean, or e.g. "//x" would not match a limit of "/x".
+// Returns false if the request was responded to.
+//
+func (s *HttpServer) rateLimit(w *HttpResponse, r *http.Request, urlpath string) bool {
+  for _, l := range s.limiters {
+    if _, ok := l.c.pattern.Match(urlpath); !ok {
+      continue
+    }
+    ok, wait := l.Allow(l.clientKey(r), time.Now())
+    if ok {
+      return true
+    }
+    secs := int(math.Ceil(wait.Seconds()))
+    w.Header().Set("Retry-After", strconv.Itoa(secs))
+    s.replyStatus(w, http.StatusTooManyRequests, nil)
+    return false
+  }
+  return true
+}
+
+
+// parseRateLimitKey parses the key of a rate limit config, which is "ip" or
+// "header:Name". Returns the header name, or "" for "ip".
+//
+func parseRateLimitKey(key string) (string, error) {
+  if key == "" || key == "ip" {
+    return "", nil
+  }
+  if strings.HasPrefix(key, "header:") {
+    if name := strings.TrimSpace(key[len("header:"):]); name != "" {
+      return http.CanonicalHeaderKey(name), nil
+    }
+  }
+  return "", errorf("invalid key %q (expected \"ip\" or \"header:Name\")", key)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+  "net/http"
+  "net/http/httptest"
+  "testing"
+  "time"
+)
+
+
+func newTestRateLimiter(rate float64, burst, maxClients int) *RateLimiter {
+  return NewRateLimiter(&RateLimitConfig{
+    Rate: rate,
+    Burst: burst,
+    MaxClients: maxClients,
+  }, nil)
+}
+
+
+func TestRateLimiterAllow(t *testing.T) {
+  l := newTestRateLimiter(2, 3, 10)  // 3 at once, then one per 500ms
+  t0 := time.Now()
+
+  for i, tc := range []struct {
+    key   string
+    at    time.Duration  // since t0
+    ok    bool
+    wait  time.Duration  // expected wait when not ok
+  }{
+    { "a", 0, true, 0 },
+    { "a", 0, true, 0 },
+    { "a", 0, true, 0 },
+    { "a", 0, false, 500 * time.Millisecond },
+    { "b", 0, true, 0 },  // other clients have their own bucket
+    { "a", 250 * time.Millisecond, false, 250 * time.Millisecond },
+    { "a", 500 * time.Millisecond, true, 0 },
+    { "a", 500 * time.Millisecond, false, 500 * time.Millisecond },
+    { "a", 10 * time.Second, true, 0 },  // refilled, up to burst
+    { "a", 10 * time.Second, true, 0 },
+    { "a", 10 * time.Second, true, 0 },
+    { "a", 10 * time.Second, false, 500 * time.Millisecond },
+  } {
+    ok, wait := l.Allow(tc.key, t0.Add(tc.at))
+    if ok != tc.ok || (!ok && absDuration(wait - tc.wait) > time.Millisecond) {
+      t.Errorf("#%d Allow(%q, +%v) = %v, %v; expected %v, %v",
+        i, tc.key, tc.at, ok, wait, tc.ok, tc.wait)
+    }
+  }
+}
+
+
+func absDuration(d time.Duration) time.Duration {
+  if d < 0 {
+    return -d
+  }
+  return d
+}
+
+
+func TestRateLimiterMaxClients(t *testing.T) {
+  l := newTestRateLimiter(1, 1, 2)
+  t0 := time.Now()
+
+  l.Allow("a", t0)
+  l.Allow("b", t0)
+  l.Allow("a", t0)  // a is now the most recently seen client
+  l.Allow("c", t0)  // evicts b
+
+  if len(l.clients) != 2 || l.lru.Len() != 2 {
+    t.Fatalf("tracking %d clients (%d in lru), expected 2", len(l.clients), l.lru.Len())
+  }
+  if _, ok := l.clients["b"]; ok {
+    t.Errorf("least recently seen client b was not evicted")
+  }
+  if ok, _ := l.Allow("a", t0); ok {
+    t.Errorf("bucket of a was reset")
+  }
+}
+
+
+func TestRateLimiterSweep(t *testing.T) {
+  l := newTestRateLimiter(1, 2, 100)  // fill time 2s
+  t0 := l.swept
+
+  l.Allow("a", t0)
+  l.Allow("b", t0.Add(1500 * time.Millisecond))
+  l.Allow("c", t0.Add(2500 * time.Millisecond))  // sweeps a
+
+  if _, ok := l.clients["a"]; ok {
+    t.Errorf("idle client a was not swept")
+  }
+  if len(l.clients) != 2 || l.lru.Len() != 2 {
+    t.Errorf("tracking %d clients (%d in lru), expected 2", len(l.clients), l.lru.Len())
+  }
+}
+
+
+func TestRateLimiterClientKey(t *testing.T) {
+  trusted, err := ParseTrustedProxies([]string{ "10.0.0.0/8" })
+  if err != nil {
+    t.Fatal(err)
+  }
+  c := &RateLimitConfig{ Key: "header:X-Api-Key" }
+  if c.header, err = parseRateLimitKey(c.Key); err != nil {
+    t.Fatal(err)
+  }
+  l := NewRateLimiter(c, trusted)
+
+  for _, tc := range []struct {
+    remoteAddr, apiKey, expect string
+  }{
+    { "10.0.0.1:1234", "k1", "h:k1" },
+    { "10.0.0.1:1234", "", "10.0.0.1" },
+    { "192.0.2.1:1234", "k1", "192.0.2.1" },  // untrusted header
+  } {
+    r := httptest.NewRequest("GET", "/", nil)
+    r.RemoteAddr = tc.remoteAddr
+    if tc.apiKey != "" {
+      r.Header.Set("X-Api-Key", tc.apiKey)
+    }
+    if key := l.clientKey(r); key != tc.expect {
+      t.Errorf("clientKey from %s with key %q = %q, expected %q",
+        tc.remoteAddr, tc.apiKey, key, tc.expect)
+    }
+  }
+}
+
+
+func TestParseRateLimitKey(t *testing.T) {
+  for _, tc := range []struct {
+    key, header string
+    ok bool
+  }{
+    { "", "", true },
+    { "ip", "", true },
+    { "header:x-api-key", "X-Api-Key", true },
+    { "header: X-Real-IP ", "X-Real-Ip", true },
+    { "header:", "", false },
+    { "cookie:id", "", false },
+  } {
+    header, err := parseRateLimitKey(tc.key)
+    if header != tc.header || (err == nil) != tc.ok {
+      t.Errorf("parseRateLimitKey(%q) = %q, %v", tc.key, header, err)
+    }
+  }
+}
+
+
+func TestRateLimitUncleanPath(t *testing.T) {
+  s, cleanup := newTestServer(t, map[string]string{
+    "x": "x",
+    "y": "y",
+  }, `
+servers:
+  - address: localhost:0
+    type: http
+    rate-limits:
+      - match: /x
+        rate: 0.001
+        burst: 1
+`)
+  defer cleanup()
+
+  for _, tc := range []struct {
+    urlpath string
+    status  int
+  }{
+    { "/x", http.StatusOK },
+    { "/x", http.StatusTooManyRequests },
+    { "//x", http.StatusTooManyRequests },
+    { "/a/../x", http.StatusTooManyRequests },
+    { "/./x", http.StatusTooManyRequests },
+    { "/y", http.StatusOK },
+  } {
+    w := testGet(s, tc.urlpath, "")
+    expectStatus(t, w, tc.urlpath, tc.status)
+  }
+}
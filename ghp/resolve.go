@@ -0,0 +1,342 @@
+package main
+
+import (
+  "net/http"
+  "os"
+  "path"
+  "path/filepath"
+  "strings"
+)
+
+// resourceKind is the kind of resource a request path resolves to
+//
+type resourceKind int
+
+const (
+  resNotFound resourceKind = iota
+  resFile      // plain file
+  resPage      // page template
+  resServlet   // servlet directory
+  resDirList   // listing of directory
+  resRedirect  // redirect to canonical URL path
+)
+
+
+// resource is what a request path resolves to in the pub-dir of a site
+//
+type resource struct {
+  kind     resourceKind
+  fspath   string          // file, or directory of servlet or listing
+  file     *os.File        // open file or directory. May be nil
+  d        os.FileInfo     // stats of file
+  dc       *dirConfig      // configuration of the directory serving the path
+  dirlist  *HtmlDirLister  // lister for resDirList
+  pathInfo string          // path below servlet directory for servlet subtrees
+  location string          // URL path for resRedirect
+}
+
+
+func (res *resource) Close() {
+  if res.file != nil {
+    res.file.Close()
+    res.file = nil
+  }
+}
+
+
+// urlPath returns the pub-dir path of the resource, e.g. "/secret.html" for
+// the clean URL "/secret" or "/app/" for a servlet directory.
+// Returns "" for resources which are not a file or directory.
+//
+func (res *resource) urlPath(site *Site) string {
+  switch res.kind {
+  case resFile, resPage, resServlet, resDirList:
+    urlpath := "/"
+    if rel := relfile(site.pubdir, res.fspath); rel != "." {
+      urlpath += filepath.ToSlash(rel)
+      if res.kind == resServlet || res.kind == resDirList {
+        urlpath += "/"
+      }
+    }
+    return urlpath
+  }
+  return ""
+}
+
+
+// resolve maps fspath, the pub-dir path of request r, to the resource which
+// serves it. dc is the configuration of dirpath, the directory of fspath.
+// The first of these wins:
+//
+//   1. A file, which is a page if it has the page or Markdown file extension.
+//      With clean-urls redirect, a URL with one of the clean-urls extensions
+//      is redirected to the URL without it, e.g. "/about.html" to "/about".
+//   2. The first index file of a directory (see Site.indexNames), which is
+//      a page, a plain file or servlet.go.
+//   3. With clean-urls, a file with fspath plus one of the clean-urls
+//      extensions, e.g. "about.ghp" or "about.html" for "/about".
+//   4. The servlet in the nearest parent directory.
+//   5. A listing of a directory without an index file, if enabled.
+//   6. The fallback of the directory (see resolveFallback).
+//
+func (s *HttpServer) resolve(site *Site, dc *dirConfig, dirpath, fspath string, r *http.Request) (*resource, error) {
+  res := &resource{ fspath: fspath, dc: dc }
+
+  if file, d, err := openFile(fspath); err == nil {
+    res.file, res.d = file, d
+    if !d.IsDir() {
+      if location := s.cleanUrlRedirect(site, res, r); location != "" {
+        res.Close()
+        return &resource{ kind: resRedirect, dc: dc, location: location }, nil
+      }
+      s.resolveFile(site, res)
+      return res, nil
+    }
+
+    // the directory's own configuration applies to its index and listing
+    if dirpath != fspath {
+      if res.dc, err = site.dirConfigs.Get(fspath); err != nil {
+        res.Close()
+        return nil, err
+      }
+    }
+    if ok, err := s.resolveIndex(site, res); ok || err != nil {
+      if err != nil {
+        res.Close()
+      }
+      return res, err
+    }
+  } else if !strings.HasSuffix(r.URL.Path, "/") && s.resolveCleanUrl(site, res, r.URL.Path) {
+    return res, nil
+  }
+
+  if dir, pathInfo := s.findServletDir(site, r.URL.Path); dir != "" {
+    res.Close()
+    return &resource{ kind: resServlet, fspath: dir, dc: res.dc, pathInfo: pathInfo }, nil
+  }
+
+  if res.file != nil {
+    if dirlist := s.dirLister(site, res.dc); dirlist != nil {
+      res.kind = resDirList
+      res.dirlist = dirlist
+      return res, nil
+    }
+  }
+
+  res.Close()
+  if fb, err := s.resolveFallback(site, res.dc, r); fb != nil || err != nil {
+    return fb, err
+  }
+  res.kind = resNotFound
+  return res, nil
+}
+
+
+// resolveFallback resolves the fallback set with "fallback" in .ghp.yaml
+// for a missing path in a directory with configuration dc, e.g. the
+// index.html of a single-page app with client-side routing. The fallback
+// is a file, page, or directory with an index file or servlet.
+// Returns nil if there is no fallback, for requests other than GET and
+// HEAD, and for paths with a file extension, like missing .js or .css
+// files.
+//
+func (s *HttpServer) resolveFallback(site *Site, dc *dirConfig, r *http.Request) (*resource, error) {
+  if dc == nil || dc.fallback == "" || (r.Method != "GET" && r.Method != "HEAD") {
+    return nil, nil
+  }
+  if path.Ext(r.URL.Path) != "" {
+    return nil, nil
+  }
+
+  f, d, err := openFile(dc.fallback)
+  if err != nil {
+    logf("fallback of %s: %v", relfile(site.pubdir, dc.dir), err)
+    return nil, nil
+  }
+  res := &resource{ fspath: dc.fallback, file: f, d: d, dc: dc }
+  if !d.IsDir() {
+    if res.dc, err = site.dirConfigs.Get(filepath.Dir(res.fspath)); err == nil {
+      s.resolveFile(site, res)
+      return res, nil
+    }
+  } else if res.dc, err = site.dirConfigs.Get(res.fspath); err == nil {
+    var ok bool
+    if ok, err = s.resolveIndex(site, res); ok && err == nil {
+      if res.kind == resServlet {
+        // the servlet serves the request path as if it was in its subtree
+        dir := ""
+        if rel := relfile(site.pubdir, res.fspath); rel != "." {
+          dir = "/" + filepath.ToSlash(rel)
+        }
+        res.pathInfo = r.URL.Path
+        if strings.HasPrefix(r.URL.Path, dir + "/") {
+          res.pathInfo = r.URL.Path[len(dir):]
+        }
+      }
+      return res, nil
+    }
+  }
+  res.Close()
+  return nil, err
+}
+
+
+// resolveFile sets the kind of res, which is a file, to page or plain file
+//
+func (s *HttpServer) resolveFile(site *Site, res *resource) {
+  // Note: We need to test for page before plain files as the page
+  // file extension might be ".html"
+  if site.pageCache != nil &&
+     (filepath.Ext(res.fspath) == site.pageExt(res.dc) || site.pageCache.isMarkdown(res.fspath)) {
+    res.kind = resPage
+  } else {
+    res.kind = resFile
+  }
+}
+
+
+// resolveIndex resolves res, which is a directory, to its first index file.
+// Returns false if it has none.
+//
+func (s *HttpServer) resolveIndex(site *Site, res *resource) (bool, error) {
+  names, err := res.file.Readdirnames(0)
+  if err != nil {
+    return false, err
+  }
+  exists := make(map[string]bool, len(names))
+  for _, name := range names {
+    exists[name] = true
+  }
+
+  for _, name := range site.indexNames(res.dc) {
+    if !exists[name] {
+      continue
+    }
+    if name == "servlet.go" {
+      if site.servletCache == nil {
+        continue
+      }
+      res.kind = resServlet
+      return true, nil
+    }
+    f, d, err := openFile(pjoin(res.fspath, name))
+    if err != nil {
+      if os.IsNotExist(err) {
+        continue  // removed since listing the directory
+      }
+      return false, err
+    }
+    if d.IsDir() {
+      f.Close()
+      continue
+    }
+    res.Close()
+    res.fspath, res.file, res.d = f.Name(), f, d
+    s.resolveFile(site, res)
+    return true, nil
+  }
+  return false, nil
+}
+
+
+// resolveCleanUrl resolves res, which does not exist, to the first file
+// which exists with res.fspath plus one of the clean-urls extensions and is
+// not denied. Returns false if there is none or clean-urls is disabled.
+//
+func (s *HttpServer) resolveCleanUrl(site *Site, res *resource, urlpath string) bool {
+  for _, ext := range site.cleanUrlExts(res.dc) {
+    if res.dc.Denied(urlpath + ext, s.files, site.files) {
+      continue
+    }
+    f, d, err := openFile(res.fspath + ext)
+    if err != nil {
+      continue
+    }
+    if d.IsDir() {
+      f.Close()
+      continue
+    }
+    res.fspath, res.file, res.d = f.Name(), f, d
+    s.resolveFile(site, res)
+    return true
+  }
+  return false
+}
+
+
+// cleanUrlRedirect returns the clean URL path of the file res when it was
+// requested with one of the clean-urls extensions and clean-urls redirect
+// is enabled, e.g. "/about" for "/about.html". Returns "" if the clean URL
+// would not resolve to res, or for rewritten requests.
+//
+func (s *HttpServer) cleanUrlRedirect(site *Site, res *resource, r *http.Request) string {
+  if !site.cleanUrlsConfig().Redirect || (r.Method != "GET" && r.Method != "HEAD") {
+    return ""
+  }
+  if st := requestState(r); st != nil && st.OriginalURL.Path != r.URL.Path {
+    return ""
+  }
+  urlpath := r.URL.Path
+  ext := path.Ext(urlpath)
+  cleanpath := urlpath[:len(urlpath) - len(ext)]
+  if ext == "" || strings.HasSuffix(cleanpath, "/") {
+    return ""
+  }
+
+  // the clean URL must resolve to res; not to a directory or a file with
+  // a preceding extension
+  base := res.fspath[:len(res.fspath) - len(ext)]
+  if _, err := os.Stat(base); err == nil {
+    return ""
+  }
+  for _, e := range site.cleanUrlExts(res.dc) {
+    if e == ext {
+      return cleanpath
+    }
+    if !res.dc.Denied(cleanpath + e, s.files, site.files) && checkIsFile(base + e) == nil {
+      return ""
+    }
+  }
+  return ""
+}
+
+
+// findServletDir looks for a servlet.go file in each parent directory of
+// urlpath, starting with the closest one.
+// Returns the servlet directory and the part of urlpath below it, or
+// ("", "") if no servlet was found.
+//
+func (s *HttpServer) findServletDir(site *Site, urlpath string) (string, string) {
+  if site.servletCache == nil {
+    return "", ""
+  }
+  urlpath = cleanURLPath(urlpath)
+  dir := urlpath
+  for dir != "/" {
+    dir = path.Dir(dir)
+    fspath := filepath.Join(site.pubdir, dir)
+    if checkIsFile(pjoin(fspath, "servlet.go")) == nil {
+      if dir == "/" {
+        return fspath, urlpath
+      }
+      return fspath, urlpath[len(dir):]
+    }
+  }
+  return "", ""
+}
+
+
+// openFile opens filename and reads its stats
+//
+func openFile(filename string) (*os.File, os.FileInfo, error) {
+  f, err := os.Open(filename)
+  if err != nil {
+    return nil, nil, err
+  }
+  d, err := f.Stat()
+  if err != nil {
+    f.Close()
+    return nil, nil, err
+  }
+  return f, d, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+  "net/http/httptest"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+
+var resourceKindNames = map[resourceKind]string{
+  resNotFound: "notfound",
+  resFile: "file",
+  resPage: "page",
+  resServlet: "servlet",
+  resDirList: "dirlist",
+  resRedirect: "redirect",
+}
+
+
+func TestResolveOrder(t *testing.T) {
+  s, cleanup := newTestServer(t, map[string]string{
+    "index.ghp": "",
+    "index.html": "",
+    "about.ghp": "",
+    "about.html": "",
+    "contact.html": "",
+    "blog/index.html": "",
+    "docs/index.html": "",
+    "docs/servlet.go": "",
+    "svc/.ghp.yaml": "index: [servlet.go, index.html]\n",
+    "svc/index.html": "",
+    "svc/servlet.go": "",
+    "api/servlet.go": "",
+    "api/static.txt": "",
+    "app/.ghp.yaml": "fallback: index.html\n",
+    "app/index.html": "",
+    "app/main.js": "",
+    "empty/a/b.txt": "",
+  }, `
+pages:
+  enabled: true
+clean-urls:
+  enabled: true
+  redirect: true
+`)
+  defer cleanup()
+  site := s.g.site
+  site.servletCache = NewServletCache(site, &ServletConfig{}, "")
+
+  for _, tc := range []struct {
+    method  string
+    urlpath string
+    expect  string  // kind and pub-dir path, or location of redirects
+  }{
+    { "GET", "/", "page /index.ghp" },                // index page before index.html
+    { "GET", "/index.html", "file /index.html" },
+    { "GET", "/about", "page /about.ghp" },           // page extension first
+    { "GET", "/about.html", "file /about.html" },     // "/about" is another file
+    { "GET", "/contact", "file /contact.html" },
+    { "GET", "/contact.html", "redirect /contact" },
+    { "GET", "/blog", "file /blog/index.html" },      // directory before clean URL
+    { "GET", "/docs/", "file /docs/index.html" },     // index.html before servlet.go
+    { "GET", "/svc/", "servlet /svc/" },              // configured index order
+    { "GET", "/api/", "servlet /api/" },
+    { "GET", "/api/users/1", "servlet /api/ /users/1" },  // parent servlet
+    { "GET", "/api/static.txt", "file /api/static.txt" },  // file before servlet
+    { "GET", "/app/main.js", "file /app/main.js" },
+    { "GET", "/app/some/route", "file /app/index.html" },  // fallback
+    { "HEAD", "/app/some/route", "file /app/index.html" },
+    { "GET", "/app/missing.js", "notfound" },         // no fallback for assets
+    { "POST", "/app/some/route", "notfound" },
+    { "GET", "/empty/a/", "notfound" },               // no index or listing
+    { "GET", "/missing", "notfound" },
+  } {
+    r := httptest.NewRequest(tc.method, tc.urlpath, nil)
+    fspath := filepath.Join(site.pubdir, r.URL.Path)
+    dirpath := fspath
+    if !strings.HasSuffix(r.URL.Path, "/") {
+      dirpath = filepath.Dir(fspath)
+    }
+    dc, err := site.dirConfigs.Get(dirpath)
+    if err != nil {
+      t.Fatal(err)
+    }
+    res, err := s.resolve(site, dc, dirpath, fspath, r)
+    if err != nil {
+      t.Errorf("%s %s: %v", tc.method, tc.urlpath, err)
+      continue
+    }
+    res.Close()
+    result := resourceKindNames[res.kind]
+    if res.kind == resRedirect {
+      result += " " + res.location
+    } else if p := res.urlPath(site); p != "" {
+      result += " " + p
+    }
+    if res.pathInfo != "" {
+      result += " " + res.pathInfo
+    }
+    if result != tc.expect {
+      t.Errorf("%s %s: %q, expected %q", tc.method, tc.urlpath, result, tc.expect)
+    }
+  }
+}
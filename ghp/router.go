@@ -0,0 +1,267 @@
+package main
+
+import (
+  "net/http"
+  "path"
+  "regexp"
+  "strconv"
+  "strings"
+
+  "github.com/rsms/ghp"
+)
+
+
+// RoutePattern is a compiled URL path pattern.
+//
+// Syntax:
+//   {name}     captures one path segment as "name"
+//   {name...}  captures the rest of the path, including slashes, as "name"
+//   *          matches any characters except "/"
+//   **         matches any characters, including "/"
+//   ?          matches one character except "/"
+//
+// Unnamed wildcards (* and **) are captured by position as "1", "2", etc.
+// A pattern ending in "/" is a prefix and matches anything below it, as if
+// the pattern ended with "**".
+//
+type RoutePattern struct {
+  src   string
+  re    *regexp.Regexp
+  names []string  // capture names, aligned with re's subexpressions
+}
+
+
+func ParseRoutePattern(pattern string) (*RoutePattern, error) {
+  if len(pattern) == 0 || pattern[0] != '/' {
+    return nil, errorf("route pattern %q must start with \"/\"", pattern)
+  }
+
+  p := &RoutePattern{ src: pattern }
+  var re strings.Builder
+  re.WriteByte('^')
+
+  nanon := 0
+  anon := func() string {
+    nanon++
+    return strconv.Itoa(nanon)
+  }
+
+  s := pattern
+  if s[len(s)-1] == '/' {
+    // prefix
+    s += "**"
+  }
+
+  for i := 0; i < len(s); i++ {
+    c := s[i]
+    switch c {
+
+    case '{':
+      end := strings.IndexByte(s[i:], '}')
+      if end == -1 {
+        return nil, errorf("unterminated \"{\" in route pattern %q", pattern)
+      }
+      name := s[i+1 : i+end]
+      i += end
+      rest := strings.HasSuffix(name, "...")
+      if rest {
+        name = name[:len(name)-3]
+      }
+      if !isRouteParamName(name) {
+        return nil, errorf("invalid capture name %q in route pattern %q", name, pattern)
+      }
+      if rest {
+        re.WriteString("(.*)")
+      } else {
+        re.WriteString("([^/]+)")
+      }
+      p.names = append(p.names, name)
+
+    case '*':
+      if i+1 < len(s) && s[i+1] == '*' {
+        i++
+        if i+1 == len(s) && i > 1 && s[i-2] == '/' {
+          // trailing "/**" also matches the parent, e.g. "/foo/**" matches "/foo"
+          str := re.String()
+          re.Reset()
+          re.WriteString(str[:len(str)-1])  // remove "/"
+          re.WriteString("(?:/(.*))?")
+        } else {
+          re.WriteString("(.*)")
+        }
+      } else {
+        re.WriteString("([^/]*)")
+      }
+      p.names = append(p.names, anon())
+
+    case '?':
+      re.WriteString("[^/]")
+
+    default:
+      re.WriteString(regexp.QuoteMeta(string(c)))
+    }
+  }
+
+  re.WriteByte('$')
+
+  var err error
+  p.re, err = regexp.Compile(re.String())
+  if err != nil {
+    return nil, errorf("invalid route pattern %q: %v", pattern, err)
+  }
+  return p, nil
+}
+
+
+func isRouteParamName(name string) bool {
+  if len(name) == 0 {
+    return false
+  }
+  for _, c := range name {
+    if !(c == '_' || c == '-' ||
+         (c >= 'a' && c <= 'z') ||
+         (c >= 'A' && c <= 'Z') ||
+         (c >= '0' && c <= '9')) {
+      return false
+    }
+  }
+  return true
+}
+
+
+func (p *RoutePattern) String() string {
+  return p.src
+}
+
+
+// Match returns captures and true if pathname matches the pattern.
+// Captures is nil if the pattern has no captures.
+//
+func (p *RoutePattern) Match(pathname string) (map[string]string, bool) {
+  m := p.re.FindStringSubmatch(pathname)
+  if m == nil {
+    return nil, false
+  }
+  if len(p.names) == 0 {
+    return nil, true
+  }
+  params := make(map[string]string, len(p.names))
+  for i, name := range p.names {
+    params[name] = m[i+1]
+  }
+  return params, true
+}
+
+
+// expandRouteTarget replaces "{name}" in target with params["name"].
+// Unknown names are replaced with the empty string.
+//
+func expandRouteTarget(target string, params map[string]string) string {
+  if strings.IndexByte(target, '{') == -1 {
+    return target
+  }
+  var b strings.Builder
+  for {
+    start := strings.IndexByte(target, '{')
+    if start == -1 {
+      break
+    }
+    end := strings.IndexByte(target[start:], '}')
+    if end == -1 {
+      break
+    }
+    b.WriteString(target[:start])
+    b.WriteString(params[target[start+1 : start+end]])
+    target = target[start+end+1:]
+  }
+  b.WriteString(target)
+  return b.String()
+}
+
+
+// route finds the first route matching r and applies it.
+// Returns true if the request was fully handled, e.g. by a redirect.
+//
+func (s *HttpServer) route(w *HttpResponse, r *http.Request, st *ghp.RequestState) bool {
+  for _, rc := range s.c.Routes {
+    params, ok := rc.pattern.Match(r.URL.Path)
+    if !ok {
+      continue
+    }
+
+    st.Params = params
+
+    if rc.NoTimeout {
+      w.ClearDeadlines()
+    }
+
+    if rc.Redirect != "" {
+      s.replyRouteRedirect(w, r, rc, params)
+      return true
+    }
+
+    if rc.Proxy != "" {
+      s.proxies[rc].ServeHTTP(w, r)
+      return true
+    }
+
+    if rc.Rewrite != "" {
+      if err := rewriteRequestURL(r, expandRouteTarget(rc.Rewrite, params)); err != nil {
+        s.replyStatus(w, http.StatusBadRequest, err)
+        return true
+      }
+      if devMode {
+        logf("rewrite %q -> %q", st.OriginalURL.Path, r.URL.Path)
+      }
+    }
+
+    return false
+  }
+  return false
+}
+
+
+// rewriteRequestURL replaces r.URL with target.
+// The path of target is used as-is, since captures in it are already
+// decoded, and is cleaned. Returns an error if it's outside of "/", e.g.
+// by way of ".." in a capture.
+// Any query in target is placed before the query of the original URL.
+//
+func rewriteRequestURL(r *http.Request, target string) error {
+  urlpath, query := target, ""
+  if i := strings.IndexByte(target, '?'); i != -1 {
+    urlpath, query = target[:i], target[i+1:]
+  }
+  if !strings.HasPrefix(urlpath, "/") {
+    return errorf("rewritten path %q is not absolute", urlpath)
+  }
+  if rel := path.Clean(urlpath[1:]); rel == ".." || strings.HasPrefix(rel, "../") {
+    return errorf("rewritten path %q is outside of \"/\"", urlpath)
+  }
+  u2 := *r.URL
+  u2.Path = cleanURLPath(urlpath)
+  u2.RawPath = ""
+  if query != "" {
+    if u2.RawQuery != "" {
+      u2.RawQuery = query + "&" + u2.RawQuery
+    } else {
+      u2.RawQuery = query
+    }
+  }
+  r.URL = &u2
+  return nil
+}
+
+
+func (s *HttpServer) replyRouteRedirect(w *HttpResponse, r *http.Request, rc *RouteConfig, params map[string]string) {
+  location := expandRouteTarget(rc.Redirect, params)
+  if q := r.URL.RawQuery; q != "" && strings.IndexByte(location, '?') == -1 {
+    location += "?" + q
+  }
+  status := rc.Status
+  if status == 0 {
+    status = http.StatusFound
+  }
+  w.Header().Set("Location", location)
+  w.WriteHeader(status)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+  "testing"
+)
+
+
+// formatParams returns params as "k=v" pairs sorted by key
+//
+func formatParams(params map[string]string) string {
+  var pairs []string
+  for k, v := range params {
+    pairs = append(pairs, k + "=" + v)
+  }
+  sort.Strings(pairs)
+  return strings.Join(pairs, " ")
+}
+
+
+func TestRoutePatternMatch(t *testing.T) {
+  for _, tc := range []struct {
+    pattern string
+    path    string
+    match   bool
+    params  string
+  }{
+    { "/about", "/about", true, "" },
+    { "/about", "/about/", false, "" },
+    { "/about", "/aboutx", false, "" },
+    { "/a.b", "/axb", false, "" },
+    { "/users/{id}", "/users/42", true, "id=42" },
+    { "/users/{id}", "/users/", false, "" },
+    { "/users/{id}", "/users/42/x", false, "" },
+    { "/files/{path...}", "/files/a/b.txt", true, "path=a/b.txt" },
+    { "/files/{path...}", "/files/", true, "path=" },
+    { "/files/{path...}", "/files", false, "" },
+    { "/{lang}/docs/{page...}", "/en/docs/x/y", true, "lang=en page=x/y" },
+    { "/{a}-{b}", "/x-y", true, "a=x b=y" },
+    { "/static/", "/static/a/b", true, "1=a/b" },
+    { "/static/", "/static/", true, "1=" },
+    { "/static/", "/static", true, "1=" },
+    { "/static/", "/staticx", false, "" },
+    { "/*.html", "/index.html", true, "1=index" },
+    { "/*.html", "/a/b.html", false, "" },
+    { "/a/**/z", "/a/b/c/z", true, "1=b/c" },
+    { "/a/**", "/a", true, "1=" },
+    { "/img/?.png", "/img/a.png", true, "" },
+    { "/img/?.png", "/img/ab.png", false, "" },
+    { "/img/?.png", "/img//.png", false, "" },
+  } {
+    p, err := ParseRoutePattern(tc.pattern)
+    if err != nil {
+      t.Errorf("%s: %v", tc.pattern, err)
+      continue
+    }
+    params, ok := p.Match(tc.path)
+    if ok != tc.match {
+      t.Errorf("%s %s: match=%v, expected %v", tc.pattern, tc.path, ok, tc.match)
+    } else if s := formatParams(params); s != tc.params {
+      t.Errorf("%s %s: params %q, expected %q", tc.pattern, tc.path, s, tc.params)
+    }
+  }
+}
+
+
+func TestParseRoutePatternErrors(t *testing.T) {
+  for _, pattern := range []string{
+    "",
+    "about",
+    "/{id",
+    "/{}",
+    "/{...}",
+    "/{a b}",
+    "/{a.b}",
+  } {
+    if _, err := ParseRoutePattern(pattern); err == nil {
+      t.Errorf("%q: expected error", pattern)
+    }
+  }
+}
+
+
+func TestExpandRouteTarget(t *testing.T) {
+  params := map[string]string{ "id": "42", "path": "a/b", "1": "x" }
+  for _, tc := range []struct {
+    target string
+    expect string
+  }{
+    { "/plain", "/plain" },
+    { "/u/{id}", "/u/42" },
+    { "/u/{id}/{path}", "/u/42/a/b" },
+    { "/{id}{1}", "/42x" },
+    { "/u/{missing}", "/u/" },
+    { "/u/{id", "/u/{id" },
+    { "/u?id={id}", "/u?id=42" },
+  } {
+    if s := expandRouteTarget(tc.target, params); s != tc.expect {
+      t.Errorf("%q: %q, expected %q", tc.target, s, tc.expect)
+    }
+  }
+}
+
+
+func TestRewriteRequestURL(t *testing.T) {
+  for _, tc := range []struct {
+    url    string
+    target string
+    path   string
+    query  string
+  }{
+    { "/a", "/b", "/b", "" },
+    { "/a?y=2", "/b", "/b", "y=2" },
+    { "/a", "/b?x=1", "/b", "x=1" },
+    { "/a?y=2", "/b?x=1", "/b", "x=1&y=2" },
+    { "/a", "/b/%2e%2e%2fc", "/b/%2e%2e%2fc", "" },  // not decoded again
+    { "/a", "/b/../c/./d/", "/c/d/", "" },
+    { "/a", "//b", "/b", "" },
+  } {
+    r := httptest.NewRequest("GET", tc.url, nil)
+    if err := rewriteRequestURL(r, tc.target); err != nil {
+      t.Errorf("%s -> %s: %v", tc.url, tc.target, err)
+      continue
+    }
+    if r.URL.Path != tc.path || r.URL.RawQuery != tc.query {
+      t.Errorf("%s -> %s: %q %q, expected %q %q",
+        tc.url, tc.target, r.URL.Path, r.URL.RawQuery, tc.path, tc.query)
+    }
+  }
+
+  for _, target := range []string{ "/..", "/a/../../b", "/../etc/passwd?x", "b" } {
+    r := httptest.NewRequest("GET", "/a", nil)
+    if err := rewriteRequestURL(r, target); err == nil {
+      t.Errorf("%s: expected error, got %q", target, r.URL.Path)
+    }
+  }
+}
+
+
+// TestRewriteOutsidePubDir verifies that encoded captures can't make a
+// rewrite reach files outside of pub-dir
+//
+func TestRewriteOutsidePubDir(t *testing.T) {
+  s, cleanup := newTestServer(t, map[string]string{
+    "files/a.txt": "a",
+  }, `
+servers:
+  - address: localhost:0
+    type: http
+    routes:
+      - match: /static/{p}
+        rewrite: /files/{p}
+      - match: /all/{p...}
+        rewrite: /files/{p}
+`)
+  defer cleanup()
+  // a file next to pub-dir
+  secret := filepath.Base(s.g.site.pubdir) + "-secret.txt"
+  writeTestFiles(t, filepath.Dir(s.g.site.pubdir), map[string]string{ secret: "secret" })
+  defer os.Remove(filepath.Join(filepath.Dir(s.g.site.pubdir), secret))
+
+  for _, tc := range []struct {
+    urlpath string
+    status  int
+  }{
+    { "/static/a.txt", http.StatusOK },
+    { "/static/%252e%252e%252f%252e%252e%252f" + secret, http.StatusNotFound },
+    { "/static/%2e%2e%2f%2e%2e%2f" + secret, http.StatusNotFound },
+    { "/all/%2e%2e%252f%2e%2e%252f" + secret, http.StatusNotFound },
+    { "/all/x/../a.txt", http.StatusOK },
+  } {
+    w := testGet(s, tc.urlpath, "")
+    expectStatus(t, w, tc.urlpath, tc.status)
+    if strings.Contains(w.Body.String(), "secret") {
+      t.Errorf("GET %s: served file outside of pub-dir", tc.urlpath)
+    }
+  }
+}
@@ -5,6 +5,8 @@ import (
   "net"
   "net/http"
   "os"
+  "path/filepath"
+  "time"
 )
 
 
@@ -39,7 +41,7 @@ func (ss *serverSet) Listen(lsocks []*ConnSock) error {
 
     // find lsock
     for j, ls := range lsocks {
-      if ls.Proto == "tcp" && ls.Addr == s.Addr() {
+      if ls.Proto == s.Network() && ls.Addr == s.Addr() {
         if devMode {
           logf("adopted existing listener for server %v", s)
         }
@@ -56,7 +58,23 @@ func (ss *serverSet) Listen(lsocks []*ConnSock) error {
 
     if l == nil {
       // no lsock found; create new listener
-      if l, err = net.Listen("tcp", s.Addr()); err != nil {
+      if s.Network() == "unix" {
+        l, err = listenUnix(s.Addr())
+      } else {
+        l, err = net.Listen("tcp", s.Addr())
+      }
+      if err != nil {
+        ss.CloseListeners()
+        return err
+      }
+    }
+
+    if ul, ok := l.(*net.UnixListener); ok {
+      // The socket file must outlive the listener when it is handed over to
+      // another process by zdr. HttpServer removes the file when done.
+      ul.SetUnlinkOnClose(false)
+      if err = setSocketPerms(s.Addr(), s.c); err != nil {
+        l.Close()
         ss.CloseListeners()
         return err
       }
@@ -75,6 +93,46 @@ func (ss *serverSet) Listen(lsocks []*ConnSock) error {
 }
 
 
+// listenUnix creates a unix socket listener at path, replacing any stale
+// socket file left behind by a process which is no longer running.
+//
+func listenUnix(path string) (net.Listener, error) {
+  os.MkdirAll(filepath.Dir(path), 0755)
+  l, err := net.Listen("unix", path)
+  if isAddrInUse(err) {
+    c, err2 := net.Dial("unix", path)
+    if err2 == nil {
+      // another process is listening
+      c.Close()
+      return nil, err
+    }
+    if isConnRefused(err2) {
+      os.Remove(path)
+      l, err = net.Listen("unix", path)
+    }
+  }
+  return l, err
+}
+
+
+// setSocketPerms applies socket-mode and socket-owner of c to the socket
+// file at path
+//
+func setSocketPerms(path string, c *ServerConfig) error {
+  if c.socketMode != 0 {
+    if err := os.Chmod(path, c.socketMode); err != nil {
+      return err
+    }
+  }
+  if c.socketUid != -1 || c.socketGid != -1 {
+    if err := os.Chown(path, c.socketUid, c.socketGid); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+
 // Serve runs all servers' "serve" functions in separate goroutines
 // and returns once all servers are done.
 // Servers must already be listening for connections.
@@ -146,6 +204,7 @@ func (ss *serverSet) CloseListeners() error {
   var err error
   for _, s := range ss.httpServers {
     if s.l != nil {
+      s.unlinkSocket()
       if e := s.l.Close(); e != nil {
         err = e
       }
@@ -156,15 +215,18 @@ func (ss *serverSet) CloseListeners() error {
 }
 
 
-func (ss *serverSet) Shutdown() error {
+// Shutdown gracefully shuts down all servers, waiting up to timeout for
+// requests in flight to complete. Servers which have connections left at
+// the deadline are closed, and the deadline error is returned.
+//
+func (ss *serverSet) Shutdown(timeout time.Duration) error {
+  ctx, cancel := context.WithTimeout(context.Background(), timeout)
+  defer cancel()
   return fanApply(ss.httpServers[:], func(v interface{}) error {
-    // d := time.Now().Add(30 * time.Second)
-    // ctx, cancel := context.WithDeadline(context.Background(), d)
-    // defer cancel()
-    ctx := context.Background()
-    err := v.(*HttpServer).Shutdown(ctx)
+    s := v.(*HttpServer)
+    err := s.Shutdown(ctx)
     if err != nil {
-      ss.Close()
+      s.Close()
     }
     return err
   })
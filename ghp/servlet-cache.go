@@ -10,12 +10,14 @@ import (
 )
 
 type ServletCache struct {
-  g        *Ghp
+  site     *Site
   c        *ServletConfig
   srcdir   string  // where servlet sources are located
   builddir string  // where servlet .so files are stored
+  middleware bool  // holds middleware rather than servlets. See Middleware
 
   items    map[string]*Servlet  // ready servlets
+  failed   map[string]bool      // servlets whose last build failed
   itemsmu  sync.RWMutex
 
   buildq   map[string]chan *Servlet
@@ -23,64 +25,69 @@ type ServletCache struct {
 }
 
 
-func NewServletCache(g *Ghp, c *ServletConfig, builddir string) *ServletCache {
+func NewServletCache(site *Site, c *ServletConfig, builddir string) *ServletCache {
   return &ServletCache{
-    g: g,
+    site: site,
     c: c,
-    srcdir:   g.config.PubDir,
+    srcdir:   site.pubdir,
     builddir: builddir,
     items:    make(map[string]*Servlet),
+    failed:   make(map[string]bool),
   }
 }
 
 
-func (c *ServletCache) LoadAll() error {
+// LoadAll builds and loads all servlets (or middleware) in srcdir.
+// Returns the names of servlets which failed, and the first error.
+//
+func (c *ServletCache) LoadAll() ([]string, error) {
   var wg sync.WaitGroup
-  errch := make(chan error, 10)
+  var failed []string
+  var firstErr error
+  var mu sync.Mutex
+  fail := func(name string, err error) {
+    mu.Lock()
+    failed = append(failed, name)
+    if firstErr == nil {
+      firstErr = err
+    }
+    mu.Unlock()
+  }
 
   // scan srcdir for servlets
   err := FileScan(c.srcdir, func (dir string, names []string) error {
     // look at directory entries
     for _, name := range names {
-      if name == "servlet.go" {
+      if name == c.entryFilename() {
         // it's a servlet
         wg.Add(1)
         go func() {
           servletdir, err := filepath.Rel(c.srcdir, dir)
           if err != nil {
-            maybeSendError(errch, err)
+            fail(dir, err)
           } else if _, err := c.Get(servletdir); err != nil {
-            maybeSendError(errch, err)
+            fail(servletdir, err)
           }
           wg.Done()
         }()
+        if c.middleware {
+          return nil  // middleware may be nested
+        }
         return filepath.SkipDir  // do no visit subdirectories
       }
     }
     return nil
   })
   if err != nil {
-    return nil
+    return nil, nil
   }
 
   // wait for servlets to finish loading
   logf("waiting for servlets to finish loading")
   wg.Wait()
 
-  // read results
-  result_loop:
-  for {
-    select {
-    case err := <- errch:
-      if err != nil {
-        return err
-      }
-    default:
-      break result_loop
-    }
-  }
-
-  return nil
+  sort.Strings(failed)
+  return failed, firstErr
 }
 
 
@@ -181,17 +188,24 @@ func (c *ServletCache) Build(name string, prevs *Servlet) (*Servlet, error) {
   s := NewServlet(c, c.servletDir(name), name)
 
   // Build
-  if prevs == nil {  // no previous servlet instance
-    if c.c.HotReload {
-      err := s.initHotReload()
-      if err != nil {
-        logf("[servlet %q] initHotReload error: %s", s, err.Error())
-      }
+  if prevs == nil && c.c.HotReload {  // no previous servlet instance
+    err := s.initHotReload()
+    if err != nil {
+      logf("[servlet %q] initHotReload error: %s", s, err.Error())
     }
+  }
+  if err := checkServletDir(s.dir); err != nil {
+    s.builderr = err
+  } else if prevs == nil {
     c.buildAndLoadServletInit(s)
   } else {
     c.buildAndLoadServlet(s)
   }
+  if s.builderr != nil {
+    servletBuildErrors.Inc(name)
+  } else if prevs != nil {
+    servletReloads.Inc(name)
+  }
 
   // Place result in items map (full write-lock)
   c.itemsmu.Lock()
@@ -200,17 +214,16 @@ func (c *ServletCache) Build(name string, prevs *Servlet) (*Servlet, error) {
     s.srcGraph, prevs.srcGraph = prevs.srcGraph, s.srcGraph
   }
   c.items[name] = s  // Note: replaces prevs, if any
+  if s.builderr != nil {
+    c.failed[name] = true
+  } else {
+    delete(c.failed, name)
+  }
   c.itemsmu.Unlock()
 
   // Cleanup any replaced servlet
   if prevs != nil {
-    go func() {
-      os.Remove(prevs.libfile)
-      if prevs.stopFun != nil {
-        prevs.stopFun(prevs.ctx)
-      }
-      prevs.Dealloc()
-    }()
+    go c.retire(prevs)
   }
 
   // Clear buildq and send on chan
@@ -233,6 +246,47 @@ func (c *ServletCache) Build(name string, prevs *Servlet) (*Servlet, error) {
 }
 
 
+// Failed returns true if the last build of servlet name failed, even if it
+// has since been evicted
+//
+func (c *ServletCache) Failed(name string) bool {
+  c.itemsmu.RLock()
+  defer c.itemsmu.RUnlock()
+  return c.failed[name]
+}
+
+
+// Evict removes the servlet name from the cache and stops it.
+// The servlet is built again the next time it's requested.
+// Returns false if name is not in the cache.
+//
+func (c *ServletCache) Evict(name string) bool {
+  c.itemsmu.Lock()
+  s := c.items[name]
+  delete(c.items, name)
+  c.itemsmu.Unlock()
+  if s == nil {
+    return false
+  }
+  go c.retire(s)
+  return true
+}
+
+
+// retire stops servlet s which has been removed from the cache, and
+// removes its library file
+//
+func (c *ServletCache) retire(s *Servlet) {
+  os.Remove(s.libfile)
+  s.signalStop()
+  if err := s.callStop(); err != nil {
+    logf("[servlet] %v", err)
+  }
+  s.conns.shutdownAll()
+  s.Dealloc()
+}
+
+
 func (c *ServletCache) servletLibFile(servletName string, version int64) string {
   return pjoin(c.builddir, servletName, strconv.FormatInt(version, 10) + ".so")
 }
@@ -269,6 +323,33 @@ func (c *ServletCache) findServletLibFile(servletName string) string {
 // }
 
 
+// checkServletDir returns an error if dir has both a servlet.go and a
+// middleware.go file. Each is built from the whole package of its
+// directory, so both would include the other's code, run its init
+// functions and have their own copy of its variables.
+//
+func checkServletDir(dir string) error {
+  if checkIsFile(pjoin(dir, "servlet.go")) == nil &&
+     checkIsFile(pjoin(dir, middlewareFilename)) == nil {
+    return errorf(
+      "%s: servlet.go and %s can not be in the same directory;" +
+      " put the servlet in a subdirectory", dir, middlewareFilename)
+  }
+  return nil
+}
+
+
+// entryFilename returns the name of the file which makes a directory a
+// servlet, or middleware
+//
+func (c *ServletCache) entryFilename() string {
+  if c.middleware {
+    return middlewareFilename
+  }
+  return "servlet.go"
+}
+
+
 func (c *ServletCache) servletDir(servletName string) string {
   return pjoin(c.srcdir, servletName)
 }
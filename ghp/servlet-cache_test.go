@@ -0,0 +1,39 @@
+package main
+
+import (
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "testing"
+)
+
+
+func TestCheckServletDir(t *testing.T) {
+  dir, err := ioutil.TempDir("", "ghp-test")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+
+  for _, tc := range []struct {
+    files []string
+    ok    bool
+  }{
+    { []string{ "servlet.go" }, true },
+    { []string{ "middleware.go" }, true },
+    { []string{ "middleware.go", "servlet.go" }, false },
+  } {
+    sub, err := ioutil.TempDir(dir, "")
+    if err != nil {
+      t.Fatal(err)
+    }
+    for _, name := range tc.files {
+      if err := ioutil.WriteFile(filepath.Join(sub, name), []byte("package main\n"), 0600); err != nil {
+        t.Fatal(err)
+      }
+    }
+    if err := checkServletDir(sub); (err == nil) != tc.ok {
+      t.Errorf("checkServletDir with %v: error %v", tc.files, err)
+    }
+  }
+}
@@ -2,6 +2,8 @@ package main
 
 import (
   "strconv"
+
+  "github.com/rsms/ghp"
 )
 
 // servletContext is the implementation of ghp.ServletContext
@@ -16,3 +18,7 @@ func (c *servletContext) Version() string {
 func (c *servletContext) Name() string {
   return c.s.name
 }
+
+func (c *servletContext) Metrics() ghp.Metrics {
+  return metrics
+}
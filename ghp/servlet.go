@@ -3,6 +3,8 @@ package main
 import (
   "fmt"
   "plugin"
+  "sync"
+  "time"
 
   "github.com/rsms/ghp"
 )
@@ -14,10 +16,15 @@ type Servlet struct {
   version   int64     // Unix nanotime of .so mtime
   libfile   string    // library file
   ctx       *servletContext
-  serveHTTP ghp.ServeHTTP    // never nil
+  serveHTTP ghp.ServeHTTP    // never nil for servlets
+  middleware ghp.Middleware  // never nil for middleware
   stopFun   ghp.StopServlet  // may be nil
+  maxBodySize int64          // from MaxBodySize. 0 for server default
   builderr  error
   srcGraph  *SrcGraph        // may be nil
+  conns     connSet          // connections hijacked by the servlet
+  stopping  chan struct{}    // closed when the servlet is stopping
+  stopOnce  sync.Once
 }
 
 
@@ -26,6 +33,7 @@ func NewServlet(cache *ServletCache, dir, name string) *Servlet {
     cache: cache,
     dir: dir,
     name: name,
+    stopping: make(chan struct{}),
   }
   s.ctx = &servletContext{s: s}
   return s
@@ -48,7 +56,10 @@ func (s *Servlet) Build() error {
   g.Cmd.Dir = s.dir
 
   // run go build
+  start := time.Now()
   _, stderr, err := g.RunBufferedIO()
+  servletBuildDuration.Observe(time.Since(start).Seconds(), s.name)
+  servletBuilds.Inc(s.name)
   if err != nil {
     logf("[servlet] go build failed: %s\n%s", err.Error(), stderr.String())
     return makeGoBuildError(
@@ -69,16 +80,30 @@ func (s *Servlet) Load() error {
   if err != nil {
     return errorf("plugin.Open failed: %v", err)
   }
+  servletLoads.Inc(s.name)
 
-  // ServeHTTP
-  sym, err := o.Lookup("ServeHTTP")
-  if err != nil {
-    return errorf("missing ServeHTTP function")
-  }
-  if fn, ok := sym.(ghp.ServeHTTP); ok {
-    s.serveHTTP = fn
+  if s.cache.middleware {
+    // Middleware
+    sym, err := o.Lookup("Middleware")
+    if err != nil {
+      return errorf("missing Middleware function")
+    }
+    if fn, ok := sym.(ghp.Middleware); ok {
+      s.middleware = fn
+    } else {
+      return errorf("incorrect signature of Middleware function")
+    }
   } else {
-    return errorf("incorrect signature of ServeHTTP function")
+    // ServeHTTP
+    sym, err := o.Lookup("ServeHTTP")
+    if err != nil {
+      return errorf("missing ServeHTTP function")
+    }
+    if fn, ok := sym.(ghp.ServeHTTP); ok {
+      s.serveHTTP = fn
+    } else {
+      return errorf("incorrect signature of ServeHTTP function")
+    }
   }
 
   // StopServlet (optional)
@@ -90,6 +115,16 @@ func (s *Servlet) Load() error {
     }
   }
 
+  // MaxBodySize (optional) overrides the server's max-body-size.
+  // A negative value means no limit. Not used by middleware.
+  if sym, err := o.Lookup("MaxBodySize"); err == nil && !s.cache.middleware {
+    if v, ok := sym.(*int64); ok {
+      s.maxBodySize = *v
+    } else {
+      return errorf("MaxBodySize must be of type int64")
+    }
+  }
+
   // StartServlet (optional)
   if sym, err := o.Lookup("StartServlet"); err == nil {
     if fn, ok := sym.(ghp.StartServlet); ok {
@@ -111,6 +146,7 @@ func (s *Servlet) Dealloc() {
   logf("[servlet] %q/%d dealloc", s.String(), s.version)
   s.name = ""
   s.serveHTTP = nil
+  s.middleware = nil
   s.builderr = nil
   if s.srcGraph != nil {
     s.srcGraph.Close()
@@ -124,16 +160,57 @@ func (s *Servlet) String() string {
 }
 
 
+// signalStop notifies requests in flight, e.g. event streams, that the
+// servlet is stopping.
+//
+func (s *Servlet) signalStop() {
+  s.stopOnce.Do(func() { close(s.stopping) })
+}
+
+
 func (s *Servlet) Stop() error {
+  s.signalStop()
   if s.srcGraph != nil {
     s.srcGraph.Close()
     s.srcGraph = nil
   }
-  if s.stopFun != nil {
-    s.stopFun(s.ctx)
-    s.stopFun = nil
+  err := s.callStop()
+  s.conns.shutdownAll()
+  return err
+}
+
+
+// callStop calls the servlet's StopServlet function, if any, waiting at
+// most shutdown.stop-servlet-timeout for it to return. A StopServlet which
+// times out is left running and an error is returned.
+//
+func (s *Servlet) callStop() error {
+  fn := s.stopFun
+  if fn == nil {
+    return nil
+  }
+  s.stopFun = nil
+
+  done := make(chan struct{})
+  go func() {
+    defer close(done)
+    defer func() {
+      if r := recover(); r != nil {
+        logf("[servlet %s] panic in StopServlet: %v", s, r)
+      }
+    }()
+    fn(s.ctx)
+  }()
+
+  timeout := s.cache.site.g.config.Shutdown.StopServletTimeout
+  timer := time.NewTimer(timeout)
+  defer timer.Stop()
+  select {
+  case <-done:
+    return nil
+  case <-timer.C:
+    return errorf("StopServlet of servlet %q did not return within %s", s.name, timeout)
   }
-  return nil
 }
 
 
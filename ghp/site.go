@@ -0,0 +1,305 @@
+package main
+
+import (
+  "net"
+  "os"
+  "strings"
+)
+
+// Site is a pub-dir served by GHP, with its own page and servlet caches.
+//
+// The top-level pub-dir of the configuration is the default site, used for
+// any request with a Host which doesn't match any configured site.
+//
+type Site struct {
+  g             *Ghp
+  c             *SiteConfig
+  pubdir        string
+  appCacheDir   string  // site-specific data cache
+  appBuildDir   string  // site-specific build products
+  dirlist       *HtmlDirLister  // nil unless enabled by c.DirList
+  dirConfigs    *DirConfigCache  // per-directory .ghp.yaml files
+  servletCache  *ServletCache
+  middlewareCache *ServletCache  // middleware.go files
+  pageCache     *PageCache
+  files         *FileFilter  // private files of the site, e.g. layouts. May be nil
+  defaultIndexNames []string
+  helperfuns    HelpersMap
+  preloadFailed []string  // names of servlets which failed to preload
+  preloadFailedMiddleware []string
+}
+
+
+func NewSite(g *Ghp, c *SiteConfig) *Site {
+  return &Site{
+    g: g,
+    c: c,
+    pubdir: c.PubDir,
+  }
+}
+
+
+func (s *Site) String() string {
+  if len(s.c.Hosts) == 0 {
+    return "Site(default)"
+  }
+  return "Site(" + strings.Join(s.c.Hosts, ",") + ")"
+}
+
+
+// init initializes the site's page and servlet systems.
+// appCacheDir and appBuildDir must be set.
+//
+func (s *Site) init() error {
+  s.dirConfigs = NewDirConfigCache(s)
+
+  // init directory lister
+  if s.c.DirList != nil && s.c.DirList.Enabled {
+    var err error
+    if s.dirlist, err = NewHtmlDirLister(s.pubdir, s.c.DirList); err != nil {
+      return err
+    }
+  }
+
+  // init pages system
+  if c := s.pagesConfig(); c.Enabled {
+    s.helperfuns = s.buildHelpers(getBaseHelpers())
+    s.pageCache = NewPageCache(s, c)
+    // layouts of Markdown pages are only used as parents
+    if s.pageCache.mdext != "" {
+      s.files = NewFileFilter("/", []string{s.pageCache.layout}, nil)
+    }
+  }
+
+  // index files in order of preference
+  if len(s.c.Index) > 0 {
+    s.defaultIndexNames = s.c.Index
+  } else if len(s.g.config.Index) > 0 {
+    s.defaultIndexNames = s.g.config.Index
+  } else {
+    s.defaultIndexNames = []string{"index.html", "servlet.go"}
+    if s.pageCache != nil {
+      s.defaultIndexNames = append([]string{"index" + s.pageCache.fileext}, s.defaultIndexNames...)
+      if s.pageCache.mdext != "" {
+        s.defaultIndexNames = append(s.defaultIndexNames, "index" + s.pageCache.mdext)
+      }
+    }
+  }
+
+  // init servlet system
+  if c := s.servletConfig(); c.Enabled {
+    if err := s.initServlets(c); err != nil {
+      return err
+    }
+  }
+
+  return nil
+}
+
+
+func (s *Site) initServlets(c *ServletConfig) error {
+  builddir := pjoin(s.appBuildDir, "servlet")
+
+  if !c.Recycle {
+    os.RemoveAll(builddir)
+  }
+
+  // setup servlet and middleware caches
+  s.servletCache = NewServletCache(s, c, builddir)
+  s.middlewareCache = NewMiddlewareCache(s, c, pjoin(s.appBuildDir, "middleware"))
+  if !c.Recycle {
+    os.RemoveAll(s.middlewareCache.builddir)
+  }
+
+  if c.Preload {
+    failed, err := s.servletCache.LoadAll()
+    if err != nil {
+      logf("[%s] %d servlets failed to preload: %v", s, len(failed), err)
+      s.preloadFailed = failed
+    }
+    failed, err = s.middlewareCache.LoadAll()
+    if err != nil {
+      logf("[%s] %d middleware failed to preload: %v", s, len(failed), err)
+      s.preloadFailedMiddleware = failed
+    }
+  }
+
+  return nil
+}
+
+
+// preloadFailures returns the names of servlets and middleware which failed
+// to preload and have not since been rebuilt successfully
+//
+func (s *Site) preloadFailures() []string {
+  var names []string
+  for _, name := range s.preloadFailed {
+    if s.servletCache.Failed(name) {
+      names = append(names, name)
+    }
+  }
+  for _, name := range s.preloadFailedMiddleware {
+    if s.middlewareCache.Failed(name) {
+      names = append(names, pjoin(name, middlewareFilename))
+    }
+  }
+  return names
+}
+
+
+// pageExt returns the file extension of pages in a directory with config dc
+//
+func (s *Site) pageExt(dc *dirConfig) string {
+  if dc != nil && dc.pageExt != "" {
+    return dc.pageExt
+  }
+  if s.pageCache != nil {
+    return s.pageCache.fileext
+  }
+  return ""
+}
+
+
+// indexNames returns the names of index files, in order of preference,
+// in a directory with config dc
+//
+func (s *Site) indexNames(dc *dirConfig) []string {
+  if dc != nil {
+    if dc.index != nil {
+      return dc.index
+    }
+    if dc.pageExt != "" && s.pageCache != nil {
+      names := []string{"index" + dc.pageExt, "index.html", "servlet.go"}
+      if s.pageCache.mdext != "" {
+        names = append(names, "index" + s.pageCache.mdext)
+      }
+      return names
+    }
+  }
+  return s.defaultIndexNames
+}
+
+
+func (s *Site) pagesConfig() *PagesConfig {
+  if s.c.Pages != nil {
+    return s.c.Pages
+  }
+  return &s.g.config.Pages
+}
+
+
+func (s *Site) cleanUrlsConfig() *CleanUrlsConfig {
+  if s.c.CleanUrls != nil {
+    return s.c.CleanUrls
+  }
+  return &s.g.config.CleanUrls
+}
+
+
+// cleanUrlExts returns the file extensions tried for clean URLs in a
+// directory with config dc, or nil if clean URLs are disabled
+//
+func (s *Site) cleanUrlExts(dc *dirConfig) []string {
+  c := s.cleanUrlsConfig()
+  if !c.Enabled {
+    return nil
+  }
+  if len(c.Extensions) > 0 {
+    return c.Extensions
+  }
+  if pageExt := s.pageExt(dc); pageExt != "" && pageExt != ".html" {
+    return []string{pageExt, ".html"}
+  }
+  return []string{".html"}
+}
+
+
+func (s *Site) servletConfig() *ServletConfig {
+  if s.c.Servlet != nil {
+    return s.c.Servlet
+  }
+  return &s.g.config.Servlet
+}
+
+
+func (s *Site) Close() {
+  if s.servletCache != nil {
+    s.servletCache.Close()
+  }
+  if s.middlewareCache != nil {
+    s.middlewareCache.Close()
+  }
+}
+
+
+// signalStop notifies requests in flight that the site's servlets are
+// stopping.
+//
+func (s *Site) signalStop() {
+  if s.servletCache != nil {
+    for _, servlet := range s.servletCache.Servlets() {
+      servlet.signalStop()
+    }
+  }
+}
+
+
+func (s *Site) Shutdown() error {
+  var err error
+  if s.servletCache != nil {
+    err = s.servletCache.Shutdown()
+  }
+  if s.middlewareCache != nil {
+    if e := s.middlewareCache.Shutdown(); e != nil && err == nil {
+      err = e
+    }
+  }
+  return err
+}
+
+
+// MatchHost returns true if host matches any of the site's host patterns.
+// host should be lower-case and without port number.
+//
+func (s *Site) MatchHost(host string) bool {
+  for _, pattern := range s.c.Hosts {
+    if matchHostPattern(pattern, host) {
+      return true
+    }
+  }
+  return false
+}
+
+
+// matchHostPattern returns true if host matches pattern.
+// A pattern is either a hostname, "*.domain" which matches any subdomain of
+// domain, or "*" which matches anything.
+//
+func matchHostPattern(pattern, host string) bool {
+  if pattern == "*" {
+    return true
+  }
+  if strings.HasPrefix(pattern, "*.") {
+    return strings.HasSuffix(host, pattern[1:])
+  }
+  return pattern == host
+}
+
+
+// siteForHost returns the site which serves requests for host, which is the
+// value of a HTTP Host header, e.g. "example.com:8080".
+//
+func (g *Ghp) siteForHost(host string) *Site {
+  if len(g.sites) > 0 {
+    if h, _, err := net.SplitHostPort(host); err == nil {
+      host = h
+    }
+    host = strings.ToLower(strings.TrimSuffix(host, "."))
+    for _, site := range g.sites {
+      if site.MatchHost(host) {
+        return site
+      }
+    }
+  }
+  return g.site
+}
@@ -8,19 +8,19 @@ import (
 type ConnSock struct {
   Fd    int
   Proto string  // e.g. "tcp" or "unix"
-  Addr  string  // host:port e.g. "127.0.0.1:1234"
+  Addr  string  // host:port e.g. "127.0.0.1:1234", or path for "unix"
 }
 
 func ParseConnSock(s string) (*ConnSock, error) {
-  // "proto:host:port"
-  v := strings.SplitN(s, ":", 3)
-  if len(v) != 3 {
+  // "tcp:host:port" or "unix:path"
+  v := strings.SplitN(s, ":", 2)
+  if len(v) != 2 || v[1] == "" {
     return nil, errorf("invalid format for ParseConnSock %q", s)
   }
 
   return &ConnSock{
     Proto: v[0],
-    Addr: v[1] + ":" + v[2],
+    Addr: v[1],
   }, nil
 }
 
@@ -33,7 +33,7 @@ func fatalf(msg interface{}, arg... interface{}) {
     format = fmt.Sprintf("%v", msg)
   }
   fmt.Fprintf(os.Stderr, format + "\n", arg...)
-  os.Exit(1)
+  os.Exit(exitError)
 }
 
 // assert calls panic() if cond is not true.
@@ -156,6 +156,25 @@ func countByte(s string, b byte) int {
   return n
 }
 
+// cleanURLPath returns the shortest path equivalent to the URL path p, like
+// path.Clean of "/" + p, but keeping any trailing slash
+func cleanURLPath(p string) string {
+  clean := path.Clean("/" + p)
+  if strings.HasSuffix(p, "/") && clean != "/" {
+    clean += "/"
+  }
+  return clean
+}
+
+// concatStrings returns a new slice of the strings of lists, in order
+func concatStrings(lists ...[]string) []string {
+  var v []string
+  for _, l := range lists {
+    v = append(v, l...)
+  }
+  return v
+}
+
 // trySendError attempts to put err on channel errch
 func maybeSendError(errch chan error, err error) bool {
   select {
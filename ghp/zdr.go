@@ -174,6 +174,8 @@ func (z *Zdr) takeOverMaster(addr *net.UnixAddr, deadline time.Time) ([]*ConnSoc
   }
 
   // acquired master role!
+  zdrHandovers.Inc("received")
+
   // dispatch master loop (reads and writes messages)
   go z.masterLoop()
 
@@ -207,7 +209,7 @@ func (z *Zdr) releaseMasterRole(conn net.Conn) error {
 
     // add to fds arrat
     fds[i + 1] = fd
-    fduris[i + 1] = "tcp:" + s.Addr()
+    fduris[i + 1] = s.Network() + ":" + s.Addr()
 
     // detach listener from server
     s.l = nil
@@ -228,6 +230,7 @@ func (z *Zdr) releaseMasterRole(conn net.Conn) error {
   // detach master listener
   z.masterln = nil
   z.masterlnfd = -1
+  zdrHandovers.Inc("released")
 
   // shutdown
   if err := z.shutdown(); err != nil {
@@ -251,7 +254,7 @@ func (z *Zdr) shutdown() error {
         err = errorf("panic in Zdr g.Shutdown: %v", r)
       }
     }()
-    z.g.Shutdown()
+    err = z.g.Shutdown()
   }()
 
   z.shutdownch <- err
@@ -0,0 +1,80 @@
+package main
+
+import (
+  "io/ioutil"
+  "net"
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+)
+
+
+// counterValue returns the value of the series of c with labelValues
+//
+func counterValue(c interface{}, labelValues ...string) float64 {
+  m := c.(counterMetric)
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  return m.getSeries(labelValues).value
+}
+
+
+func TestZdrHandoverCounter(t *testing.T) {
+  dir, err := ioutil.TempDir("", "ghp-test")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  sockpath := filepath.Join(dir, "zdr.sock")
+  addr := &net.UnixAddr{ Net: "unix", Name: sockpath }
+  received := counterValue(zdrHandovers, "received")
+
+  // becoming the initial master is not a handover
+  z1 := NewZdr(nil, sockpath)
+  if err := z1.becomeInitialMaster(addr); err != nil {
+    t.Fatal(err)
+  }
+  z1.masterln.Close()
+  if v := counterValue(zdrHandovers, "received"); v != received {
+    t.Errorf("received %v handovers after becomeInitialMaster; expected %v", v, received)
+  }
+
+  // a master releasing its listener to z2
+  os.Remove(sockpath)
+  ln, err := net.ListenUnix("unix", addr)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer ln.Close()
+  go func() {
+    conn, err := ln.Accept()
+    if err != nil {
+      return
+    }
+    defer conn.Close()
+    if _, err := NewIpcMsgReader(conn).Read(cmdTakeOver); err != nil {
+      t.Error(err)
+      return
+    }
+    fd, err := getListenerFd(ln)
+    if err == nil {
+      err = NewIpcMsgWriter(conn).Write(cmdFdInfo, "unix:" + sockpath)
+    }
+    if err == nil {
+      err = FdExchangeSendFDs(conn, fd)
+    }
+    if err != nil {
+      t.Error(err)
+    }
+  }()
+
+  z2 := NewZdr(nil, sockpath)
+  if _, err := z2.takeOverMaster(addr, time.Now().Add(5 * time.Second)); err != nil {
+    t.Fatal(err)
+  }
+  z2.masterln.Close()
+  if v := counterValue(zdrHandovers, "received"); v != received + 1 {
+    t.Errorf("received %v handovers after takeOverMaster; expected %v", v, received + 1)
+  }
+}
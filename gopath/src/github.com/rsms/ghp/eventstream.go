@@ -0,0 +1 @@
+../../../../../eventstream.go
\ No newline at end of file
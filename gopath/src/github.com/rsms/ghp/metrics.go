@@ -0,0 +1 @@
+../../../../../metrics.go
\ No newline at end of file
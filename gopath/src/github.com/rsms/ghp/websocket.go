@@ -0,0 +1 @@
+../../../../../websocket.go
\ No newline at end of file
@@ -0,0 +1,49 @@
+package ghp
+
+// Metrics registers metrics which are exported by GHP in the Prometheus
+// text format, when metrics are enabled in the GHP config.
+//
+// Metric names must match [a-zA-Z_:][a-zA-Z0-9_:]* and should be prefixed
+// with the name of the servlet's application, e.g. "myapp_logins_total".
+// Registering a metric which already exists returns the existing metric,
+// so a servlet can register its metrics each time it's started and keep
+// counting across reloads. Registering a name with a different type or
+// different labels panics.
+//
+// Methods of metrics take values for the labels the metric was registered
+// with, in the same order, and panic if the number of values is wrong.
+//
+type Metrics interface {
+  Counter(name, help string, labels ...string) Counter
+  Gauge(name, help string, labels ...string) Gauge
+
+  // Histogram registers a histogram with upper bounds buckets, in
+  // increasing order. DefaultBuckets is used if buckets is nil.
+  Histogram(name, help string, buckets []float64, labels ...string) Histogram
+}
+
+// Counter is a value which only goes up, e.g. number of requests served
+//
+type Counter interface {
+  Inc(labelValues ...string)
+  Add(v float64, labelValues ...string)  // v must be >= 0
+}
+
+// Gauge is a value which goes up and down, e.g. number of open connections
+//
+type Gauge interface {
+  Set(v float64, labelValues ...string)
+  Add(v float64, labelValues ...string)
+}
+
+// Histogram counts observations, e.g. durations in seconds, in buckets
+//
+type Histogram interface {
+  Observe(v float64, labelValues ...string)
+}
+
+// DefaultBuckets are histogram buckets suitable for durations in seconds
+//
+var DefaultBuckets = []float64{
+  .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10,
+}
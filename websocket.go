@@ -0,0 +1,323 @@
+package ghp
+
+import (
+  "bufio"
+  "crypto/sha1"
+  "encoding/base64"
+  "encoding/binary"
+  "errors"
+  "io"
+  "net"
+  "net/http"
+  "strings"
+  "sync"
+  "time"
+)
+
+// WebSocket message types
+//
+const (
+  TextMessage   = 1
+  BinaryMessage = 2
+)
+
+// WebSocket close status codes
+//
+const (
+  CloseNormal        = 1000
+  CloseGoingAway     = 1001
+  CloseProtocolError = 1002
+  CloseTooLarge      = 1009
+)
+
+// DefaultWebSocketReadLimit is the default maximum size of a message
+//
+const DefaultWebSocketReadLimit = 1 << 20
+
+const (
+  wsOpContinuation = 0
+  wsOpText         = 1
+  wsOpBinary       = 2
+  wsOpClose        = 8
+  wsOpPing         = 9
+  wsOpPong         = 10
+)
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var ErrWebSocketClosed = errors.New("websocket closed")
+
+// WebSocket is a server-side WebSocket connection (RFC 6455).
+// ReadMessage should be called from one goroutine only.
+// WriteMessage and Close are safe to call from any goroutine.
+//
+type WebSocket struct {
+  ReadLimit int64  // max size of a message. Defaults to DefaultWebSocketReadLimit
+
+  conn   net.Conn
+  br     *bufio.Reader
+  wmu    sync.Mutex  // serializes writes
+  closed bool        // true after a close frame has been sent
+}
+
+// UpgradeWebSocket performs the WebSocket opening handshake for request r,
+// hijacking the connection of w. Any headers set on w are included in the
+// handshake response.
+//
+// On failure, an error is returned and, if the connection was not yet
+// hijacked, a "400 Bad Request" response is written.
+//
+// The connection is closed with status CloseGoingAway when the server
+// shuts down or the servlet is replaced.
+//
+func UpgradeWebSocket(r *Request, w Response) (*WebSocket, error) {
+  hr := (*http.Request)(r)
+  var err error
+  if hr.Method != "GET" {
+    err = errors.New("websocket: method not GET")
+  } else if !headerContainsToken(hr.Header, "Connection", "upgrade") ||
+            !headerContainsToken(hr.Header, "Upgrade", "websocket") {
+    err = errors.New("websocket: not a websocket handshake")
+  } else if hr.Header.Get("Sec-Websocket-Version") != "13" {
+    w.Header().Set("Sec-WebSocket-Version", "13")
+    err = errors.New("websocket: unsupported version")
+  }
+  key := hr.Header.Get("Sec-Websocket-Key")
+  if err == nil && key == "" {
+    err = errors.New("websocket: missing Sec-WebSocket-Key")
+  }
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return nil, err
+  }
+
+  h := w.Header()
+  h.Del("Content-Type")
+  h.Set("Upgrade", "websocket")
+  h.Set("Connection", "Upgrade")
+  h.Set("Sec-WebSocket-Accept", webSocketAcceptKey(key))
+
+  conn, rw, err := w.Hijack()
+  if err != nil {
+    return nil, err
+  }
+
+  rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+  h.Write(rw)
+  rw.WriteString("\r\n")
+  if err := rw.Flush(); err != nil {
+    conn.Close()
+    return nil, err
+  }
+
+  ws := &WebSocket{
+    ReadLimit: DefaultWebSocketReadLimit,
+    conn: conn,
+    br: rw.Reader,
+  }
+
+  if c, ok := conn.(interface{ OnShutdown(func()) }); ok {
+    c.OnShutdown(func() {
+      ws.CloseWithStatus(CloseGoingAway, "server shutting down")
+    })
+  }
+
+  return ws, nil
+}
+
+// Conn returns the underlying connection
+//
+func (ws *WebSocket) Conn() net.Conn {
+  return ws.conn
+}
+
+// ReadMessage reads the next text or binary message, transparently
+// answering pings. Returns io.EOF when the peer has closed the connection.
+//
+func (ws *WebSocket) ReadMessage() (messageType int, data []byte, err error) {
+  var msg []byte
+  msgType := 0
+  for {
+    fin, opcode, payload, err := ws.readFrame()
+    if err != nil {
+      return 0, nil, err
+    }
+    switch opcode {
+
+    case wsOpPing:
+      ws.writeFrame(wsOpPong, payload)
+
+    case wsOpPong:
+      // ignore
+
+    case wsOpClose:
+      status := CloseNormal
+      if len(payload) >= 2 {
+        status = int(binary.BigEndian.Uint16(payload))
+      }
+      ws.CloseWithStatus(status, "")
+      return 0, nil, io.EOF
+
+    case wsOpText, wsOpBinary, wsOpContinuation:
+      if opcode == wsOpContinuation {
+        if msgType == 0 {
+          ws.CloseWithStatus(CloseProtocolError, "")
+          return 0, nil, errors.New("websocket: unexpected continuation frame")
+        }
+      } else {
+        if msgType != 0 {
+          ws.CloseWithStatus(CloseProtocolError, "")
+          return 0, nil, errors.New("websocket: expected continuation frame")
+        }
+        msgType = int(opcode)
+      }
+      if int64(len(msg) + len(payload)) > ws.ReadLimit {
+        ws.CloseWithStatus(CloseTooLarge, "")
+        return 0, nil, errors.New("websocket: message too large")
+      }
+      msg = append(msg, payload...)
+      if fin {
+        return msgType, msg, nil
+      }
+
+    default:
+      ws.CloseWithStatus(CloseProtocolError, "")
+      return 0, nil, errors.New("websocket: unknown opcode")
+    }
+  }
+}
+
+// WriteMessage sends a text or binary message
+//
+func (ws *WebSocket) WriteMessage(messageType int, data []byte) error {
+  if messageType != TextMessage && messageType != BinaryMessage {
+    return errors.New("websocket: invalid message type")
+  }
+  return ws.writeFrame(byte(messageType), data)
+}
+
+// Close closes the connection with status CloseNormal
+//
+func (ws *WebSocket) Close() error {
+  return ws.CloseWithStatus(CloseNormal, "")
+}
+
+// CloseWithStatus sends a close frame with status and reason, and closes
+// the connection. Calling it more than once has no effect.
+//
+func (ws *WebSocket) CloseWithStatus(status int, reason string) error {
+  payload := make([]byte, 2 + len(reason))
+  binary.BigEndian.PutUint16(payload, uint16(status))
+  copy(payload[2:], reason)
+  ws.wmu.Lock()
+  if ws.closed {
+    ws.wmu.Unlock()
+    return nil
+  }
+  ws.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+  ws.writeFrameLocked(wsOpClose, payload)
+  ws.closed = true
+  ws.wmu.Unlock()
+  return ws.conn.Close()
+}
+
+func (ws *WebSocket) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+  var hdr [8]byte
+  if _, err = io.ReadFull(ws.br, hdr[:2]); err != nil {
+    return
+  }
+  fin = hdr[0] & 0x80 != 0
+  opcode = hdr[0] & 0x0f
+  masked := hdr[1] & 0x80 != 0
+  length := int64(hdr[1] & 0x7f)
+
+  switch length {
+  case 126:
+    if _, err = io.ReadFull(ws.br, hdr[:2]); err != nil {
+      return
+    }
+    length = int64(binary.BigEndian.Uint16(hdr[:2]))
+  case 127:
+    if _, err = io.ReadFull(ws.br, hdr[:8]); err != nil {
+      return
+    }
+    length = int64(binary.BigEndian.Uint64(hdr[:8]))
+  }
+
+  if !masked {
+    // clients must mask all frames
+    ws.CloseWithStatus(CloseProtocolError, "")
+    err = errors.New("websocket: unmasked client frame")
+    return
+  }
+  if length < 0 || length > ws.ReadLimit {
+    ws.CloseWithStatus(CloseTooLarge, "")
+    err = errors.New("websocket: frame too large")
+    return
+  }
+
+  var mask [4]byte
+  if _, err = io.ReadFull(ws.br, mask[:]); err != nil {
+    return
+  }
+  payload = make([]byte, length)
+  if _, err = io.ReadFull(ws.br, payload); err != nil {
+    return
+  }
+  for i := range payload {
+    payload[i] ^= mask[i % 4]
+  }
+  return
+}
+
+func (ws *WebSocket) writeFrame(opcode byte, payload []byte) error {
+  ws.wmu.Lock()
+  defer ws.wmu.Unlock()
+  if ws.closed {
+    return ErrWebSocketClosed
+  }
+  return ws.writeFrameLocked(opcode, payload)
+}
+
+func (ws *WebSocket) writeFrameLocked(opcode byte, payload []byte) error {
+  var hdr [10]byte
+  hdr[0] = 0x80 | opcode  // FIN
+  n := 2
+  switch {
+  case len(payload) < 126:
+    hdr[1] = byte(len(payload))
+  case len(payload) <= 0xffff:
+    hdr[1] = 126
+    binary.BigEndian.PutUint16(hdr[2:], uint16(len(payload)))
+    n += 2
+  default:
+    hdr[1] = 127
+    binary.BigEndian.PutUint64(hdr[2:], uint64(len(payload)))
+    n += 8
+  }
+  if _, err := ws.conn.Write(hdr[:n]); err != nil {
+    return err
+  }
+  _, err := ws.conn.Write(payload)
+  return err
+}
+
+func webSocketAcceptKey(key string) string {
+  h := sha1.New()
+  io.WriteString(h, key + wsGUID)
+  return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerContainsToken returns true if the comma-separated header name
+// contains token, compared case-insensitively.
+//
+func headerContainsToken(h http.Header, name, token string) bool {
+  for _, v := range h[http.CanonicalHeaderKey(name)] {
+    for _, t := range strings.Split(v, ",") {
+      if strings.EqualFold(strings.TrimSpace(t), token) {
+        return true
+      }
+    }
+  }
+  return false
+}